@@ -2,13 +2,39 @@ package api
 
 import (
 	"context"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/ipfs/go-cid"
+	"github.com/snapshot_snake/snapshot"
 )
 
 type SnapAPI interface {
 	GetDagNode() ([]cid.Cid, error)
 	ChainGetTipSet(context.Context, types.TipSetKey) (*types.TipSet, error)
-	SnapDagExport(context.Context, *types.TipSet, int64) (<-chan []byte, error)
+	ChainGetTipSetByHeight(context.Context, abi.ChainEpoch) (*types.TipSet, error)
+	SnapDagExport(context.Context, *types.TipSet, ExportOptions) (<-chan []byte, error)
+	SnapDagExportDiff(context.Context, *types.TipSet, *types.TipSet, ExportOptions) (<-chan []byte, error)
 	GetCacheRange() (int, error)
+	// SnapImport loads a snapshot car in the import dir of the daemon into the cache
+	SnapImport(context.Context, string) (*snapshot.ImportResult, error)
+	// SnapExportJobs lists the running and queued exports and the recently finished ones
+	SnapExportJobs(context.Context) ([]snapshot.ExportJob, error)
+	// SnapExportJob returns the export job with the id
+	SnapExportJob(context.Context, string) (snapshot.ExportJob, error)
+	// SnapExportCancel cancels the export job with the id
+	SnapExportCancel(context.Context, string) error
+	// Shutdown gracefully stops the daemon
+	Shutdown(context.Context) error
+}
+
+type ExportOptions struct {
+	// RecentStateroots is the number of recent state roots to include in the export
+	RecentStateroots int64
+	// Format of the exported car, "carv1" or "carv2" with an index section
+	Format string
+	// Compression of the exported stream, "none", "zstd" or "gzip"
+	Compression string
+	// JobID identifies the export job, so callers can follow it while it streams. A random id is
+	// assigned when empty.
+	JobID string
 }
@@ -3,80 +3,151 @@ package api
 import (
 	"bufio"
 	"context"
-	"fmt"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/node/modules/dtypes"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/snapshot"
 	"github.com/snapshot_snake/snapshot/saaf"
+	"github.com/snapshot_snake/snapshot/store"
 	"go.uber.org/fx"
-	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 	"io"
+	"sync"
 )
 
 var _ SnapAPI = (*SnapNodeAPI)(nil)
 var log = logging.Logger("rpc")
 
 type SnapNodeAPI struct {
-	fx.In
+	fx.In `ignore-unexported:"true"`
 
 	Ds common.DagStore
 
 	Src *saaf.SnapSource
+
+	Shutter *snapshot.Shutter
+
+	ShutdownCh dtypes.ShutdownChan
+	// shutdownOnce guards the shutdown channel against concurrent Shutdown calls
+	shutdownOnce sync.Once
+}
+
+func (f *SnapNodeAPI) Shutdown(ctx context.Context) error {
+	f.shutdownOnce.Do(func() {
+		log.Warn("shutdown requested over rpc")
+		close(f.ShutdownCh)
+	})
+	return nil
 }
 
 func (f *SnapNodeAPI) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
-	// Fetch tipset block headers from blockstore in parallel
-	var eg errgroup.Group
-	cids := tsk.Cids()
-	blks := make([]*types.BlockHeader, len(cids))
-	for i, c := range cids {
-		i, c := i, c
-		eg.Go(func() error {
-			b, err := f.Ds.Get(ctx, c)
-			if err != nil {
-				return xerrors.Errorf("get block %s: %w", c, err)
-			}
+	// the headers come from the source window, the cache may have evicted them
+	return f.Shutter.LoadTipSet(tsk)
+}
 
-			blk, err := types.DecodeBlock(b.RawData())
-			if err != nil {
-				return xerrors.Errorf("decode block err: %s", err)
-			}
-			blks[i] = blk
-			return nil
-		})
+func (f *SnapNodeAPI) ChainGetTipSetByHeight(ctx context.Context, height abi.ChainEpoch) (*types.TipSet, error) {
+	// null rounds resolve to the previous non-empty height
+	_, cids, err := f.Src.LookbackPointers(saaf.Height(height))
+	if err != nil {
+		return nil, err
 	}
-	err := eg.Wait()
-	if blks[0].Cid() == blks[1].Cid() {
-		return nil, fmt.Errorf("common...")
+
+	return f.ChainGetTipSet(ctx, types.NewTipSetKey(cids...))
+}
+
+func (f *SnapNodeAPI) SnapDagExport(ctx context.Context, ts *types.TipSet, opts ExportOptions) (<-chan []byte, error) {
+	if err := f.checkExportOptions(opts); err != nil {
+		return nil, err
 	}
+
+	job, err := f.Shutter.Jobs().Add(ctx, snapshot.ExportJob{
+		ID:           opts.JobID,
+		Kind:         "full",
+		Source:       snapshot.JobSourceRPC,
+		Height:       ts.Height(),
+		OldestHeight: abi.ChainEpoch(f.Src.OldestHeight()),
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	ts, err := types.NewTipSet(blks)
+	return exportStream(ctx, func(w io.Writer) error {
+		return job.Run(w, func(ctx context.Context, w io.Writer) error {
+			return store.ExportCompressed(ctx, f.Ds, ts, w, opts.RecentStateroots, opts.Format, opts.Compression)
+		})
+	}), nil
+}
+
+func (f *SnapNodeAPI) SnapDagExportDiff(ctx context.Context, from, to *types.TipSet, opts ExportOptions) (<-chan []byte, error) {
+	if err := f.checkExportOptions(opts); err != nil {
+		return nil, err
+	}
+	if from.Height() >= to.Height() {
+		return nil, xerrors.Errorf("base tipset height %d is not below target height %d", from.Height(), to.Height())
+	}
+
+	job, err := f.Shutter.Jobs().Add(ctx, snapshot.ExportJob{
+		ID:           opts.JobID,
+		Kind:         "diff",
+		Source:       snapshot.JobSourceRPC,
+		Height:       to.Height(),
+		OldestHeight: abi.ChainEpoch(f.Src.OldestHeight()),
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return ts, nil
+	return exportStream(ctx, func(w io.Writer) error {
+		return job.Run(w, func(ctx context.Context, w io.Writer) error {
+			return store.WriteCompressed(w, opts.Format, opts.Compression, func(w io.Writer) error {
+				return f.Ds.ExportDiff(ctx, from, to, w, opts.RecentStateroots)
+			})
+		})
+	}), nil
+}
+
+func (f *SnapNodeAPI) SnapExportJobs(ctx context.Context) ([]snapshot.ExportJob, error) {
+	return f.Shutter.Jobs().List(), nil
+}
 
+func (f *SnapNodeAPI) SnapExportJob(ctx context.Context, id string) (snapshot.ExportJob, error) {
+	return f.Shutter.Jobs().Get(id)
 }
 
-func (f *SnapNodeAPI) SnapDagExport(ctx context.Context, ts *types.TipSet, n int64) (<-chan []byte, error) {
+func (f *SnapNodeAPI) SnapExportCancel(ctx context.Context, id string) error {
+	return f.Shutter.Jobs().Cancel(id)
+}
+
+func (f *SnapNodeAPI) checkExportOptions(opts ExportOptions) error {
+	if err := f.Shutter.Config().Retention.CheckRecentStateroots(opts.RecentStateroots); err != nil {
+		return err
+	}
+	if err := store.CheckFormat(opts.Format); err != nil {
+		return err
+	}
+	return store.CheckCompression(opts.Compression)
+}
+
+// exportStream runs write in the background and streams its output in chunks, an empty
+// chunk marks the correct end of the stream
+func exportStream(ctx context.Context, write func(w io.Writer) error) <-chan []byte {
 	r, w := io.Pipe()
 	out := make(chan []byte)
 	go func() {
 		bw := bufio.NewWriterSize(w, 1<<20)
 
-		err := f.Ds.Export(ctx, ts, bw, n)
+		err := write(bw)
 		bw.Flush()
 		w.CloseWithError(err)
 	}()
 
 	go func() {
 		defer close(out)
+		// unblock the writer when the reader gives up
+		defer r.CloseWithError(xerrors.Errorf("export stream closed"))
 		for {
 			buf := make([]byte, 1<<20)
 			n, err := r.Read(buf)
@@ -106,7 +177,7 @@ func (f *SnapNodeAPI) SnapDagExport(ctx context.Context, ts *types.TipSet, n int
 		}
 	}()
 
-	return out, nil
+	return out
 }
 
 func (f *SnapNodeAPI) GetDagNode() ([]cid.Cid, error) {
@@ -117,3 +188,7 @@ func (f *SnapNodeAPI) GetDagNode() ([]cid.Cid, error) {
 func (f *SnapNodeAPI) GetCacheRange() (int, error) {
 	return f.Src.HpRange(), nil
 }
+
+func (f *SnapNodeAPI) SnapImport(ctx context.Context, path string) (*snapshot.ImportResult, error) {
+	return f.Shutter.ImportFile(ctx, path)
+}
@@ -4,8 +4,10 @@ package api
 
 import (
 	"context"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/ipfs/go-cid"
+	"github.com/snapshot_snake/snapshot"
 	"golang.org/x/xerrors"
 )
 
@@ -15,11 +17,25 @@ type SnapAPIStruct struct {
 	Internal struct {
 		ChainGetTipSet func(p0 context.Context, p1 types.TipSetKey) (*types.TipSet, error) ``
 
+		ChainGetTipSetByHeight func(p0 context.Context, p1 abi.ChainEpoch) (*types.TipSet, error) ``
+
 		GetCacheRange func() (int, error) ``
 
 		GetDagNode func() ([]cid.Cid, error) ``
 
-		SnapDagExport func(p0 context.Context, p1 *types.TipSet, p2 int64) (<-chan []byte, error) ``
+		Shutdown func(p0 context.Context) error ``
+
+		SnapDagExport func(p0 context.Context, p1 *types.TipSet, p2 ExportOptions) (<-chan []byte, error) ``
+
+		SnapDagExportDiff func(p0 context.Context, p1 *types.TipSet, p2 *types.TipSet, p3 ExportOptions) (<-chan []byte, error) ``
+
+		SnapExportCancel func(p0 context.Context, p1 string) error ``
+
+		SnapExportJob func(p0 context.Context, p1 string) (snapshot.ExportJob, error) ``
+
+		SnapExportJobs func(p0 context.Context) ([]snapshot.ExportJob, error) ``
+
+		SnapImport func(p0 context.Context, p1 string) (*snapshot.ImportResult, error) ``
 	}
 }
 
@@ -37,6 +53,17 @@ func (s *SnapAPIStub) ChainGetTipSet(p0 context.Context, p1 types.TipSetKey) (*t
 	return nil, ErrNotSupported
 }
 
+func (s *SnapAPIStruct) ChainGetTipSetByHeight(p0 context.Context, p1 abi.ChainEpoch) (*types.TipSet, error) {
+	if s.Internal.ChainGetTipSetByHeight == nil {
+		return nil, ErrNotSupported
+	}
+	return s.Internal.ChainGetTipSetByHeight(p0, p1)
+}
+
+func (s *SnapAPIStub) ChainGetTipSetByHeight(p0 context.Context, p1 abi.ChainEpoch) (*types.TipSet, error) {
+	return nil, ErrNotSupported
+}
+
 func (s *SnapAPIStruct) GetCacheRange() (int, error) {
 	if s.Internal.GetCacheRange == nil {
 		return 0, ErrNotSupported
@@ -59,14 +86,80 @@ func (s *SnapAPIStub) GetDagNode() ([]cid.Cid, error) {
 	return *new([]cid.Cid), ErrNotSupported
 }
 
-func (s *SnapAPIStruct) SnapDagExport(p0 context.Context, p1 *types.TipSet, p2 int64) (<-chan []byte, error) {
+func (s *SnapAPIStruct) Shutdown(p0 context.Context) error {
+	if s.Internal.Shutdown == nil {
+		return ErrNotSupported
+	}
+	return s.Internal.Shutdown(p0)
+}
+
+func (s *SnapAPIStub) Shutdown(p0 context.Context) error {
+	return ErrNotSupported
+}
+
+func (s *SnapAPIStruct) SnapDagExport(p0 context.Context, p1 *types.TipSet, p2 ExportOptions) (<-chan []byte, error) {
 	if s.Internal.SnapDagExport == nil {
 		return nil, ErrNotSupported
 	}
 	return s.Internal.SnapDagExport(p0, p1, p2)
 }
 
-func (s *SnapAPIStub) SnapDagExport(p0 context.Context, p1 *types.TipSet, p2 int64) (<-chan []byte, error) {
+func (s *SnapAPIStub) SnapDagExport(p0 context.Context, p1 *types.TipSet, p2 ExportOptions) (<-chan []byte, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *SnapAPIStruct) SnapDagExportDiff(p0 context.Context, p1 *types.TipSet, p2 *types.TipSet, p3 ExportOptions) (<-chan []byte, error) {
+	if s.Internal.SnapDagExportDiff == nil {
+		return nil, ErrNotSupported
+	}
+	return s.Internal.SnapDagExportDiff(p0, p1, p2, p3)
+}
+
+func (s *SnapAPIStub) SnapDagExportDiff(p0 context.Context, p1 *types.TipSet, p2 *types.TipSet, p3 ExportOptions) (<-chan []byte, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *SnapAPIStruct) SnapExportCancel(p0 context.Context, p1 string) error {
+	if s.Internal.SnapExportCancel == nil {
+		return ErrNotSupported
+	}
+	return s.Internal.SnapExportCancel(p0, p1)
+}
+
+func (s *SnapAPIStub) SnapExportCancel(p0 context.Context, p1 string) error {
+	return ErrNotSupported
+}
+
+func (s *SnapAPIStruct) SnapExportJob(p0 context.Context, p1 string) (snapshot.ExportJob, error) {
+	if s.Internal.SnapExportJob == nil {
+		return *new(snapshot.ExportJob), ErrNotSupported
+	}
+	return s.Internal.SnapExportJob(p0, p1)
+}
+
+func (s *SnapAPIStub) SnapExportJob(p0 context.Context, p1 string) (snapshot.ExportJob, error) {
+	return *new(snapshot.ExportJob), ErrNotSupported
+}
+
+func (s *SnapAPIStruct) SnapExportJobs(p0 context.Context) ([]snapshot.ExportJob, error) {
+	if s.Internal.SnapExportJobs == nil {
+		return *new([]snapshot.ExportJob), ErrNotSupported
+	}
+	return s.Internal.SnapExportJobs(p0)
+}
+
+func (s *SnapAPIStub) SnapExportJobs(p0 context.Context) ([]snapshot.ExportJob, error) {
+	return *new([]snapshot.ExportJob), ErrNotSupported
+}
+
+func (s *SnapAPIStruct) SnapImport(p0 context.Context, p1 string) (*snapshot.ImportResult, error) {
+	if s.Internal.SnapImport == nil {
+		return nil, ErrNotSupported
+	}
+	return s.Internal.SnapImport(p0, p1)
+}
+
+func (s *SnapAPIStub) SnapImport(p0 context.Context, p1 string) (*snapshot.ImportResult, error) {
 	return nil, ErrNotSupported
 }
 
@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
-	"github.com/filecoin-project/lotus/chain/types"
+	lapi "github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/node/modules/dtypes"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/pkg/errors"
@@ -67,7 +67,7 @@ var daemonStartCmd = &cli.Command{
 			monitor.ShutdownHandler{Component: "application", StopFunc: monitor.StopFunc(stopper)},
 		)
 		// monitor tsKey channel
-		var tsCh = make(chan *types.TipSet, 0)
+		var tsCh = make(chan *lapi.HeadChange, 0)
 		ch, err := components.Notifier.Sub(ctx)
 		if err != nil {
 			return fmt.Errorf("sub head change: %w", err)
@@ -123,4 +123,21 @@ func serveHTTP(addr string, mux *http.ServeMux) (func(context.Context) error, <-
 	return srv.Shutdown, errCh
 }
 
-var daemonStopCmd = &cli.Command{}
+var daemonStopCmd = &cli.Command{
+	Name:  "stop",
+	Usage: "gracefully stop a running daemon",
+	Action: func(cctx *cli.Context) error {
+		apiv0, closer, err := GetAPIV0(cctx)
+		if err != nil {
+			return fmt.Errorf("get apiv0 err: %s", err)
+		}
+		defer closer()
+
+		if err := apiv0.Shutdown(cctx.Context); err != nil {
+			return err
+		}
+
+		fmt.Println("daemon shutdown requested")
+		return nil
+	},
+}
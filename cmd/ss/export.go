@@ -2,11 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
 	"github.com/snapshot_snake/api"
+	"github.com/snapshot_snake/snapshot"
+	"github.com/snapshot_snake/snapshot/store"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -14,15 +24,42 @@ var exportCmd = &cli.Command{
 	Name: "export",
 	Subcommands: []*cli.Command{
 		exportSnapshotCmd,
+		exportDiffCmd,
+		exportJobsCmd,
+		exportCancelCmd,
 	},
 }
 
+var (
+	recentStaterootsFlag = &cli.Int64Flag{
+		Name:  "recent-stateroots",
+		Usage: "specify the number of recent state roots to include in the export",
+	}
+	exportFormatFlag = &cli.StringFlag{
+		Name:  "format",
+		Usage: "specify the format of the exported car, carv1 or carv2 with an index section",
+		Value: store.FormatCarV1,
+	}
+	exportCompressFlag = &cli.StringFlag{
+		Name:  "compress",
+		Usage: "compress the exported snapshot on the daemon side, none, zstd or gzip",
+		Value: store.CompressionNone,
+	}
+)
+
 var exportSnapshotCmd = &cli.Command{
 	Name: "snapshot",
 	Flags: []cli.Flag{
+		recentStaterootsFlag,
 		&cli.Int64Flag{
-			Name:  "recent-stateroots",
-			Usage: "specify the number of recent state roots to include in the export",
+			Name:  "height",
+			Usage: "export the snapshot at the cached tipset of this height, null rounds resolve to the previous tipset",
+		},
+		exportFormatFlag,
+		exportCompressFlag,
+		&cli.StringFlag{
+			Name:  "tipset",
+			Usage: "export the snapshot at the cached tipset with these comma separated block cids",
 		},
 	},
 	Action: func(cctx *cli.Context) error {
@@ -32,6 +69,11 @@ var exportSnapshotCmd = &cli.Command{
 		}
 		ctx := context.Background()
 
+		opts, err := LoadExportOptions(cctx)
+		if err != nil {
+			return err
+		}
+
 		//CreateExportFile
 		fi, err := CreateExportFile(cctx.App, cctx.Args().First())
 		if err != nil {
@@ -39,42 +81,291 @@ var exportSnapshotCmd = &cli.Command{
 			return err
 		}
 
-		ts, err := LoadTipSet(ctx, apiv0)
+		ts, err := LoadExportTipSet(ctx, cctx, apiv0)
 		if err != nil {
 			fmt.Println(err)
 			return err
 		}
 
-		rs := cctx.Int64("recent-stateroots")
+		rs := opts.RecentStateroots
+		opts.JobID = uuid.New().String()
 
 		begin := time.Now()
-		stream, err := apiv0.SnapDagExport(ctx, ts, rs)
+		stream, err := apiv0.SnapDagExport(ctx, ts, opts)
+		if err != nil {
+			return err
+		}
+
+		done := make(chan struct{})
+		progressDone := PrintExportProgress(ctx, apiv0, opts.JobID, done)
+		err = WriteExportStream(fi, stream)
+		close(done)
+		<-progressDone
 		if err != nil {
 			return err
 		}
 
-		var last bool
-		for b := range stream {
-			last = len(b) == 0
+		log.Infof("done export %d tipset height elapsed %s", rs, time.Now().Sub(begin).String())
+
+		return nil
+	},
+}
+
+var exportDiffCmd = &cli.Command{
+	Name:      "diff",
+	Usage:     "export the blocks reachable from the --to tipset but not from the --from tipset, with a manifest of the base roots",
+	ArgsUsage: "<file>",
+	Flags: []cli.Flag{
+		recentStaterootsFlag,
+		exportFormatFlag,
+		exportCompressFlag,
+		&cli.StringFlag{
+			Name:     "from",
+			Usage:    "comma separated block cids of the base tipset, the tipset of the previous full snapshot",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "to",
+			Usage: "comma separated block cids of the target tipset, defaults to the latest cached tipset",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		apiv0, _, err := GetAPIV0(cctx)
+		if err != nil {
+			return fmt.Errorf("get apiv0 err: %s", err)
+		}
+		ctx := context.Background()
+
+		opts, err := LoadExportOptions(cctx)
+		if err != nil {
+			return err
+		}
 
-			fmt.Println(len(b))
+		fromKey, err := ParseTipSetKey(cctx.String("from"))
+		if err != nil {
+			return err
+		}
+		from, err := apiv0.ChainGetTipSet(ctx, fromKey)
+		if err != nil {
+			return xerrors.Errorf("load base tipset: %w", err)
+		}
 
-			_, err := fi.Write(b)
-			if err != nil {
+		var to *types.TipSet
+		if cctx.IsSet("to") {
+			var toKey types.TipSetKey
+			if toKey, err = ParseTipSetKey(cctx.String("to")); err != nil {
 				return err
 			}
+			to, err = apiv0.ChainGetTipSet(ctx, toKey)
+		} else {
+			to, err = LoadTipSet(ctx, apiv0)
+		}
+		if err != nil {
+			return xerrors.Errorf("load target tipset: %w", err)
 		}
 
-		log.Infof("done export %d tipset height elapsed %s", rs, time.Now().Sub(begin).String())
+		fi, err := CreateExportFile(cctx.App, cctx.Args().First())
+		if err != nil {
+			log.Errorf("create export file err: %s", err)
+			return err
+		}
+
+		begin := time.Now()
+		stream, err := apiv0.SnapDagExportDiff(ctx, from, to, opts)
+		if err != nil {
+			return err
+		}
 
-		if !last {
-			return xerrors.Errorf("incomplete export (remote connection lost /  daemon process has not yet loaded the block into the cache?)")
+		if err := WriteExportStream(fi, stream); err != nil {
+			return err
+		}
+
+		manifest := store.DiffManifest{
+			BaseRoots:        from.Cids(),
+			BaseHeight:       from.Height(),
+			Roots:            to.Cids(),
+			Height:           to.Height(),
+			RecentStateroots: opts.RecentStateroots,
+			Format:           opts.Format,
+			Compression:      opts.Compression,
+		}
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return xerrors.Errorf("marshal manifest: %w", err)
+		}
+		manifestPath := cctx.Args().First() + ".manifest.json"
+		if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+			return xerrors.Errorf("write manifest: %w", err)
 		}
 
+		log.Infof("done export diff %d..%d elapsed %s, manifest %s", from.Height(), to.Height(), time.Now().Sub(begin).String(), manifestPath)
+
 		return nil
 	},
 }
 
+// LoadExportOptions loads the export options from the --recent-stateroots, --format and --compress flags
+func LoadExportOptions(cctx *cli.Context) (api.ExportOptions, error) {
+	format := cctx.String("format")
+	if err := store.CheckFormat(format); err != nil {
+		return api.ExportOptions{}, err
+	}
+
+	compression := cctx.String("compress")
+	if err := store.CheckCompression(compression); err != nil {
+		return api.ExportOptions{}, err
+	}
+	if ext := store.CompressionExt(compression); !strings.HasSuffix(cctx.Args().First(), ext) {
+		log.Warnf("exporting %s compressed snapshot to a file without the %s extension", compression, ext)
+	}
+
+	return api.ExportOptions{
+		RecentStateroots: cctx.Int64("recent-stateroots"),
+		Format:           format,
+		Compression:      compression,
+	}, nil
+}
+
+// WriteExportStream writes the chunks of an export stream into w
+func WriteExportStream(w io.Writer, stream <-chan []byte) error {
+	var last bool
+	for b := range stream {
+		last = len(b) == 0
+
+		_, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !last {
+		return xerrors.Errorf("incomplete export (remote connection lost /  daemon process has not yet loaded the block into the cache?)")
+	}
+
+	return nil
+}
+
+// PrintExportProgress draws a progress bar of the export job on stderr until done is closed,
+// the returned channel is closed once the last state is drawn
+func PrintExportProgress(ctx context.Context, api api.SnapAPI, id string, done <-chan struct{}) <-chan struct{} {
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			var last bool
+			select {
+			case <-done:
+				last = true
+			case <-ticker.C:
+			}
+
+			if job, err := api.SnapExportJob(ctx, id); err == nil {
+				fmt.Fprintf(os.Stderr, "\r%s", progressBar(job))
+			}
+			if last {
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+	return finished
+}
+
+// progressBar renders the walk from the exported height down to the oldest cached one
+func progressBar(job snapshot.ExportJob) string {
+	const width = 30
+
+	var frac float64
+	if span := job.Height - job.OldestHeight; span > 0 && job.CurrentHeight > 0 {
+		frac = float64(job.Height-job.CurrentHeight) / float64(span)
+	}
+	if job.State == snapshot.JobDone || frac > 1 {
+		frac = 1
+	}
+	if frac < 0 {
+		frac = 0
+	}
+	filled := int(frac * width)
+
+	return fmt.Sprintf("[%s%s] %3.0f%% %-8s height %d, %d blocks, %s    ",
+		strings.Repeat("=", filled), strings.Repeat(" ", width-filled), frac*100, job.State,
+		job.CurrentHeight, job.Blocks, humanize.IBytes(uint64(job.Bytes)))
+}
+
+var exportJobsCmd = &cli.Command{
+	Name:  "jobs",
+	Usage: "list the running and queued exports of the daemon and the recently finished ones",
+	Action: func(cctx *cli.Context) error {
+		apiv0, _, err := GetAPIV0(cctx)
+		if err != nil {
+			return fmt.Errorf("get apiv0 err: %s", err)
+		}
+
+		jobs, err := apiv0.SnapExportJobs(context.Background())
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tKIND\tSOURCE\tSTATE\tHEIGHT\tWALKED\tBLOCKS\tBYTES\tELAPSED\tERROR")
+		for _, job := range jobs {
+			elapsed := time.Since(job.Created)
+			if !job.Finished.IsZero() {
+				elapsed = job.Finished.Sub(job.Created)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\n",
+				job.ID, job.Kind, job.Source, job.State, job.Height, job.CurrentHeight, job.Blocks,
+				humanize.IBytes(uint64(job.Bytes)), elapsed.Truncate(time.Second), job.Error)
+		}
+		return tw.Flush()
+	},
+}
+
+var exportCancelCmd = &cli.Command{
+	Name:      "cancel",
+	Usage:     "cancel an export job of the daemon",
+	ArgsUsage: "<job id>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 1 {
+			return xerrors.Errorf("expected a job id")
+		}
+
+		apiv0, _, err := GetAPIV0(cctx)
+		if err != nil {
+			return fmt.Errorf("get apiv0 err: %s", err)
+		}
+
+		if err := apiv0.SnapExportCancel(context.Background(), cctx.Args().First()); err != nil {
+			return err
+		}
+
+		log.Infof("canceled export job %s", cctx.Args().First())
+		return nil
+	},
+}
+
+// LoadExportTipSet loads the tipset selected by the --tipset or --height flags, or the latest one
+func LoadExportTipSet(ctx context.Context, cctx *cli.Context, api api.SnapAPI) (*types.TipSet, error) {
+	switch {
+	case cctx.IsSet("tipset") && cctx.IsSet("height"):
+		return nil, xerrors.Errorf("only one of --tipset and --height can be set")
+	case cctx.IsSet("tipset"):
+		key, err := ParseTipSetKey(cctx.String("tipset"))
+		if err != nil {
+			return nil, err
+		}
+		return api.ChainGetTipSet(ctx, key)
+	case cctx.IsSet("height"):
+		return api.ChainGetTipSetByHeight(ctx, abi.ChainEpoch(cctx.Int64("height")))
+	default:
+		return LoadTipSet(ctx, api)
+	}
+}
+
 func LoadTipSet(ctx context.Context, api api.SnapAPI) (*types.TipSet, error) {
 	nodes, _ := api.GetDagNode()
 	// get from cache or build a ts
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"path/filepath"
+)
+
+var importCmd = &cli.Command{
+	Name:      "import",
+	Usage:     "import a snapshot car into the daemon cache, the file must be in the import dir of the daemon",
+	ArgsUsage: "<file.car>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return xerrors.Errorf("expect exactly one snapshot file")
+		}
+
+		apiv0, closer, err := GetAPIV0(cctx)
+		if err != nil {
+			return fmt.Errorf("get apiv0 err: %s", err)
+		}
+		defer closer()
+
+		path, err := filepath.Abs(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		res, err := apiv0.SnapImport(cctx.Context, path)
+		if err != nil {
+			return xerrors.Errorf("import snapshot: %w", err)
+		}
+
+		log.Infof("imported %d blocks, linked %d tipsets from height %d to %d", res.Blocks, res.Tipsets, res.OldestHeight, res.Height)
+		return nil
+	},
+}
@@ -20,6 +20,8 @@ func main() {
 			daemonCmd,
 			exportCmd,
 			heightCmd,
+			importCmd,
+			verifyCmd,
 		},
 		Version: build.UserVersion(),
 		Flags: []cli.Flag{
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/lotus/chain/types"
 	cliutil "github.com/filecoin-project/lotus/cli/util"
 	"github.com/filecoin-project/lotus/metrics"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
@@ -20,6 +22,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
@@ -99,19 +102,24 @@ func ServeRPC(a api.SnapAPI, stop ffx.StopFunc, addr multiaddr.Multiaddr, shutdo
 	shutdownDone := make(chan struct{})
 	// Start a goroutine to handle shutdown operations sync
 	go func() {
+		// the application is already stopped when the shutdown channel closes
+		stopApp := true
 		select {
 		case sig := <-sigCh:
 			log.Warnw("received shutdown", "signal", sig)
-		case <-shutdownDone:
+		case <-shutdownCh:
 			log.Warn("received shutdown")
+			stopApp = false
 		}
 
 		log.Warn("Shutting down...")
 		if err := srv.Shutdown(context.TODO()); err != nil {
 			log.Errorf("shutting down RPC server failed: %s", err)
 		}
-		if err := stop(context.TODO()); err != nil {
-			log.Errorf("graceful shutting down failed: %s", err)
+		if stopApp {
+			if err := stop(context.TODO()); err != nil {
+				log.Errorf("graceful shutting down failed: %s", err)
+			}
 		}
 		log.Warn("Graceful shutdown successful")
 		_ = log.Sync()
@@ -139,3 +147,27 @@ func CreateExportFile(app *cli.App, path string) (io.WriteCloser, error) {
 	}
 	return fi, nil
 }
+
+// ParseTipSetKey parses a tipset key of comma separated block cids, optionally wrapped in braces
+func ParseTipSetKey(s string) (types.TipSetKey, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(s), "{"), "}")
+
+	var cids []cid.Cid
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		c, err := cid.Decode(str)
+		if err != nil {
+			return types.EmptyTSK, xerrors.Errorf("parse block cid %q: %w", str, err)
+		}
+		cids = append(cids, c)
+	}
+
+	if len(cids) == 0 {
+		return types.EmptyTSK, xerrors.Errorf("empty tipset key")
+	}
+
+	return types.NewTipSetKey(cids...), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/snapshot_snake/snapshot/store"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"os"
+)
+
+var verifyCmd = &cli.Command{
+	Name:      "verify",
+	Usage:     "verify the integrity of a snapshot car, exits non-zero on corrupted, missing or extra blocks",
+	ArgsUsage: "<file.car>",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:     "recent-stateroots",
+			Usage:    "specify the number of recent state roots the snapshot was exported with",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "max-list",
+			Usage: "max number of cids listed per problem kind",
+			Value: 20,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return xerrors.Errorf("expect exactly one snapshot file")
+		}
+
+		rs := cctx.Int64("recent-stateroots")
+		if rs <= 0 {
+			return xerrors.Errorf("recent-stateroots must be positive")
+		}
+
+		fi, err := os.Open(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+		defer fi.Close() //nolint:errcheck
+
+		report, err := store.Verify(context.Background(), fi, rs)
+		if err != nil {
+			return xerrors.Errorf("verify snapshot: %w", err)
+		}
+
+		fmt.Printf("roots: %s\n", report.Roots)
+		fmt.Printf("height: %d\n", report.Height)
+		fmt.Printf("blocks: %d\n", report.Blocks)
+		fmt.Printf("headers: %d\n", report.Headers)
+		if report.TruncatedAt >= 0 {
+			fmt.Printf("chain truncated at height: %d\n", report.TruncatedAt)
+		}
+
+		max := cctx.Int("max-list")
+		printCids("corrupted", report.Corrupted, max)
+		printCids("missing", report.Missing, max)
+		printCids("extra", report.Extra, max)
+
+		if !report.OK() {
+			return xerrors.Errorf("snapshot verification failed: %d corrupted, %d missing, %d extra blocks",
+				len(report.Corrupted), len(report.Missing), len(report.Extra))
+		}
+
+		fmt.Println("snapshot ok")
+		return nil
+	},
+}
+
+func printCids(kind string, cids []cid.Cid, max int) {
+	if len(cids) == 0 {
+		return
+	}
+
+	fmt.Printf("%s: %d\n", kind, len(cids))
+	for i, c := range cids {
+		if i >= max {
+			fmt.Printf("\t... %d more\n", len(cids)-max)
+			break
+		}
+		fmt.Printf("\t%s\n", c)
+	}
+}
@@ -2,15 +2,36 @@ package common
 
 import (
 	"context"
+	lapi "github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/chain/types"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"io"
+	"time"
 )
 
+// HeadChange is a head update of a HeadNotifier, Type is one of the lotus
+// store.HCRevert, store.HCApply and store.HCCurrent
+type HeadChange struct {
+	Type string
+	Key  types.TipSetKey
+}
+
+// NotifierStatus is the state of the connection of a HeadNotifier to lotus
+type NotifierStatus struct {
+	Connected bool
+	// Since is the time of the last connection state change
+	Since time.Time
+	// Reconnects counts the connections made after the first one
+	Reconnects int
+	// LastError is the last error of the connection, empty when none happened yet
+	LastError string
+}
+
 type HeadNotifier interface {
-	Sub(ctx context.Context) (<-chan types.TipSetKey, error)
-	GetTipSet(context.Context, <-chan types.TipSetKey, chan *types.TipSet)
+	Sub(ctx context.Context) (<-chan HeadChange, error)
+	GetTipSet(context.Context, <-chan HeadChange, chan *lapi.HeadChange)
+	Status() NotifierStatus
 }
 
 type DagStore interface {
@@ -18,5 +39,8 @@ type DagStore interface {
 	DeleteBlock(context.Context, cid.Cid) error
 	Put(context.Context, cid.Cid, blocks.Block) error
 	Get(context.Context, cid.Cid) (blocks.Block, error)
+	// AllKeysChan sends the cids of the stored blocks and closes the channel
+	AllKeysChan(context.Context) (<-chan cid.Cid, error)
 	Export(context.Context, *types.TipSet, io.Writer, int64) error
+	ExportDiff(context.Context, *types.TipSet, *types.TipSet, io.Writer, int64) error
 }
@@ -1,26 +1,47 @@
 package dep
 
 import (
+	"context"
 	"fmt"
+	"github.com/filecoin-project/lotus/api/v0api"
+	"github.com/filecoin-project/lotus/node/modules/dtypes"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	fslock "github.com/ipfs/go-fs-lock"
 	"github.com/snapshot_snake/common"
 	"github.com/snapshot_snake/lib/cliex"
+	"github.com/snapshot_snake/lib/metrics"
 	"github.com/snapshot_snake/snapshot"
 	"github.com/snapshot_snake/snapshot/saaf"
+	"github.com/snapshot_snake/snapshot/store"
 	"go.uber.org/fx"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 var (
 	_ common.HeadNotifier = (*cliex.HeadSub)(nil)
+	_ common.HeadNotifier = (*cliex.HeadPoll)(nil)
+	_ common.DagStore     = (*store.CacheBlockStore)(nil)
+	_ common.DagStore     = (*store.DiskBlockStore)(nil)
+	_ common.DagStore     = (*store.TieredBlockStore)(nil)
 )
 
 func LoadConfig(path RepoPath) (snapshot.Config, error) {
 	cfgPath := ConfigFilePath(path)
-	var cfg snapshot.Config
+	// options missing from the file keep their defaults
+	cfg := snapshot.DefaultConfig()
 	_, err := FromFile(cfgPath, &cfg)
 	if err != nil {
 		return snapshot.Config{}, fmt.Errorf("read config from file %s: %w", cfgPath, err)
 	}
+	if err := cfg.Validate(); err != nil {
+		return snapshot.Config{}, fmt.Errorf("invalid config %s: %w", cfgPath, err)
+	}
 	//set 'FULLNODE_API_INFO' env var
 	lotusAPIInfo := fmt.Sprintf("%s:%s", cfg.LotusAPI.APIToken, cfg.LotusAPI.APIAddr)
 	if err := os.Setenv("FULLNODE_API_INFO", lotusAPIInfo); err != nil {
@@ -29,17 +50,184 @@ func LoadConfig(path RepoPath) (snapshot.Config, error) {
 	return cfg, nil
 }
 
+// NewHeadNotifier builds the head notifier selected in the config
+func NewHeadNotifier(cfg snapshot.Config, full v0api.FullNode) (common.HeadNotifier, error) {
+	switch cfg.LotusAPI.NotifyMode {
+	case "", snapshot.NotifyModeChan:
+		return cliex.NewHeadSub(full)
+	case snapshot.NotifyModePoll:
+		return cliex.NewHeadPoll(full, time.Duration(cfg.LotusAPI.PollInterval))
+	default:
+		return nil, fmt.Errorf("unknown notify mode %q", cfg.LotusAPI.NotifyMode)
+	}
+}
+
 type snapshotIn struct {
 	fx.In
-	Ctx GlobalContext
+	Ctx  GlobalContext
+	Cfg  snapshot.Config
+	Repo RepoPath
 
-	Sub common.HeadNotifier
-	Cs  common.DagStore
+	Full v0api.FullNode
+	Sub  common.HeadNotifier
+	Cs   common.DagStore
 
 	Dag *saaf.DAG
 	Src *saaf.SnapSource
 }
 
 func NewSnapshot(in snapshotIn) *snapshot.Shutter {
-	return snapshot.New(in.Ctx, in.Sub, in.Cs, in.Dag, in.Src)
+	cfg := in.Cfg
+	cfg.Schedule.Dir = storePath(in.Repo, cfg.Schedule.Dir)
+	cfg.Import.Dir = storePath(in.Repo, cfg.Import.Dir)
+	return snapshot.New(in.Ctx, cfg, in.Full, in.Sub, in.Cs, in.Dag, in.Src)
+}
+
+// RegisterHTTP registers the http handlers of the daemon on the mux
+func RegisterHTTP(lc fx.Lifecycle, mux *http.ServeMux, s *snapshot.Shutter) error {
+	download := snapshot.NewDownloadHandler(s)
+	mux.Handle(snapshot.DownloadPrefix, download)
+	mux.Handle(snapshot.HealthPath, snapshot.NewHealthHandler(s, false))
+	mux.Handle(snapshot.ReadyPath, snapshot.NewHealthHandler(s, true))
+
+	lc.Append(fx.Hook{
+		OnStop: func(_ context.Context) error {
+			return download.Close()
+		},
+	})
+
+	exporter, err := metrics.Exporter()
+	if err != nil {
+		return fmt.Errorf("create metrics exporter: %w", err)
+	}
+	mux.Handle(metrics.Path, exporter)
+
+	return nil
+}
+
+const (
+	repoLockFile = "repo.lock"
+	pidFile      = "daemon.pid"
+)
+
+// LockRepo locks the repo, so two daemons never run on the same repo, and writes the pid file
+func LockRepo(lc fx.Lifecycle, rpath RepoPath) error {
+	locker, err := fslock.Lock(string(rpath), repoLockFile)
+	if err != nil {
+		return fmt.Errorf("lock repo %s, is another daemon running?: %w", rpath, err)
+	}
+
+	pidPath := filepath.Join(string(rpath), pidFile)
+	if err := os.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		_ = locker.Close()
+		return fmt.Errorf("write pid file: %w", err)
+	}
+
+	lc.Append(fx.Hook{
+		OnStop: func(_ context.Context) error {
+			if err := os.Remove(pidPath); err != nil {
+				log.Warnf("remove pid file: %s", err)
+			}
+			return locker.Close()
+		},
+	})
+
+	return nil
+}
+
+// persistent reports whether the dag state should survive restarts
+func persistent(cfg snapshot.Config) bool {
+	return cfg.Store.Backend == snapshot.StoreBackendLevelDB
+}
+
+// storePath resolves a store path against the repo
+func storePath(rpath RepoPath, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(string(rpath), path)
+}
+
+// NewMetadataDS opens the datastore holding the dag state, next to the disk dag store
+func NewMetadataDS(lc fx.Lifecycle, cfg snapshot.Config, rpath RepoPath) (dtypes.MetadataDS, error) {
+	if !persistent(cfg) {
+		return dssync.MutexWrap(datastore.NewMapDatastore()), nil
+	}
+
+	path := storePath(rpath, "metadata")
+	log.Infof("open metadata store at %s", path)
+	ds, err := leveldb.NewDatastore(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open leveldb at %s: %w", path, err)
+	}
+
+	lc.Append(fx.Hook{
+		OnStop: func(_ context.Context) error {
+			return ds.Close()
+		},
+	})
+
+	return ds, nil
+}
+
+func NewNodeStore(cfg snapshot.Config, mds dtypes.MetadataDS) saaf.NodeStore {
+	if !persistent(cfg) {
+		nodes := saaf.NewMapNodeStore()
+		return &nodes
+	}
+	return saaf.NewDsNodeStore(mds)
+}
+
+func NewDAG(cfg snapshot.Config, nodes saaf.NodeStore, mds dtypes.MetadataDS) (*saaf.DAG, error) {
+	if !persistent(cfg) {
+		return saaf.NewDAG(nodes), nil
+	}
+	return saaf.LoadDAG(nodes, mds)
+}
+
+func NewSnapSource(cfg snapshot.Config, mds dtypes.MetadataDS) (*saaf.SnapSource, error) {
+	if !persistent(cfg) {
+		return saaf.NewSnapSource(int(cfg.Retention.Epochs)), nil
+	}
+	return saaf.LoadSnapSource(mds, int(cfg.Retention.Epochs))
+}
+
+// NewDagStore builds the dag store backend selected in the config
+func NewDagStore(lc fx.Lifecycle, cfg snapshot.Config, rpath RepoPath, dag *saaf.DAG) (common.DagStore, error) {
+	switch cfg.Store.Backend {
+	case "", snapshot.StoreBackendMemory:
+		return store.NewCacheBlockStore(dag, cfg.Store.CacheSize)
+	case snapshot.StoreBackendLevelDB:
+		path := storePath(rpath, cfg.Store.Path)
+		log.Infof("open disk dag store at %s", path)
+		ds, err := store.NewDiskBlockStore(dag, path)
+		if err != nil {
+			return nil, err
+		}
+
+		lc.Append(fx.Hook{
+			OnStop: func(_ context.Context) error {
+				return ds.Close()
+			},
+		})
+
+		return ds, nil
+	case snapshot.StoreBackendTiered:
+		path := storePath(rpath, cfg.Store.SpillPath)
+		log.Infof("open tiered dag store spilling to %s", path)
+		ts, err := store.NewTieredBlockStore(dag, cfg.Store.CacheSize, path)
+		if err != nil {
+			return nil, err
+		}
+
+		lc.Append(fx.Hook{
+			OnStop: func(_ context.Context) error {
+				return ts.Close()
+			},
+		})
+
+		return ts, nil
+	default:
+		return nil, fmt.Errorf("unknown dag store backend %q", cfg.Store.Backend)
+	}
 }
@@ -3,16 +3,22 @@ package dep
 import (
 	"context"
 	"fmt"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api/client"
 	"github.com/filecoin-project/lotus/api/v0api"
 	cliutil "github.com/filecoin-project/lotus/cli/util"
 	"github.com/filecoin-project/lotus/node/config"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/mitchellh/go-homedir"
+	"github.com/snapshot_snake/lib/cliex"
 	"github.com/snapshot_snake/lib/ffx"
+	"github.com/snapshot_snake/snapshot"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/fx"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 var log = logging.Logger("dep")
@@ -31,7 +37,11 @@ var (
 )
 
 func InjectFullNode(cctx *cli.Context) ffx.Option {
-	return ffx.Override(new(v0api.FullNode), func(lc fx.Lifecycle) (v0api.FullNode, error) {
+	return ffx.Override(new(v0api.FullNode), func(lc fx.Lifecycle, cfg snapshot.Config) (v0api.FullNode, error) {
+		if len(cfg.LotusAPI.Endpoints) > 0 {
+			return newFailoverFullNode(cctx, lc, cfg.LotusAPI)
+		}
+
 		full, closer, err := cliutil.GetFullNodeAPI(cctx)
 		if err != nil {
 			return nil, err
@@ -48,6 +58,46 @@ func InjectFullNode(cctx *cli.Context) ffx.Option {
 	})
 }
 
+// newFailoverFullNode connects to the configured lotus endpoints and fails over between them
+func newFailoverFullNode(cctx *cli.Context, lc fx.Lifecycle, opts snapshot.LotusAPI) (v0api.FullNode, error) {
+	endpoints := append([]snapshot.LotusEndpoint{{APIAddr: opts.APIAddr, APIToken: opts.APIToken}}, opts.Endpoints...)
+
+	dialers := make([]cliex.Dialer, 0, len(endpoints))
+	for _, ep := range endpoints {
+		info := cliutil.APIInfo{Addr: ep.APIAddr, Token: []byte(ep.APIToken)}
+		addr, err := info.DialArgs("v0")
+		if err != nil {
+			return nil, fmt.Errorf("parse lotus endpoint %s: %w", ep.APIAddr, err)
+		}
+		header := info.AuthHeader()
+
+		dialers = append(dialers, cliex.Dialer{
+			Name: ep.APIAddr,
+			Dial: func(ctx context.Context) (v0api.FullNode, jsonrpc.ClientCloser, error) {
+				return client.NewFullNodeRPCV0(ctx, addr, header)
+			},
+		})
+	}
+
+	ctx, cancel := context.WithCancel(cctx.Context)
+	fo, err := cliex.NewFailover(ctx, dialers, time.Duration(opts.HealthCheckInterval), abi.ChainEpoch(opts.MaxHeadLag))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go fo.Run(ctx)
+
+	lc.Append(fx.Hook{
+		OnStop: func(_ context.Context) error {
+			cancel()
+			fo.Close()
+			return nil
+		},
+	})
+
+	return fo.FullNode(), nil
+}
+
 func GetRepoPath(cctx *cli.Context) (RepoPath, error) {
 	dir, err := homedir.Expand(cctx.String(RepoFlag.Name))
 	if err != nil {
@@ -2,14 +2,13 @@ package dep
 
 import (
 	"context"
+	"github.com/filecoin-project/lotus/node/modules/dtypes"
 	"github.com/filecoin-project/lotus/node/modules/helpers"
 	"github.com/ipfs/go-metrics-interface"
 	"github.com/snapshot_snake/common"
-	"github.com/snapshot_snake/lib/cliex"
 	"github.com/snapshot_snake/lib/ffx"
 	"github.com/snapshot_snake/snapshot"
 	"github.com/snapshot_snake/snapshot/saaf"
-	"github.com/snapshot_snake/snapshot/store"
 	"go.uber.org/fx"
 	"net/http"
 )
@@ -17,6 +16,10 @@ import (
 const (
 	invokeNone ffx.Invoke = iota
 
+	invokeLockRepo
+
+	invokeHTTP
+
 	invokePopulate
 )
 
@@ -31,17 +34,22 @@ func Core(ctx context.Context, logger fx.Printer, target ...interface{}) ffx.Opt
 
 		// config
 		ffx.Override(new(snapshot.Config), LoadConfig),
+		ffx.Override(invokeLockRepo, LockRepo),
 
 		// notifier & dag
-		ffx.Override(new(common.HeadNotifier), cliex.NewHeadSub),
-		ffx.Override(new(*saaf.SnapSource), saaf.NewSnapSource),
-		ffx.Override(new(saaf.NodeStore), saaf.NewMapNodeStore),
-		ffx.Override(new(*saaf.DAG), saaf.NewDAG),
+		ffx.Override(new(common.HeadNotifier), NewHeadNotifier),
+		ffx.Override(new(dtypes.MetadataDS), NewMetadataDS),
+		ffx.Override(new(*saaf.SnapSource), NewSnapSource),
+		ffx.Override(new(saaf.NodeStore), NewNodeStore),
+		ffx.Override(new(*saaf.DAG), NewDAG),
 
 		//cache
-		ffx.Override(new(common.DagStore), store.NewCacheBlockStore),
+		ffx.Override(new(common.DagStore), NewDagStore),
 
 		// snapshot
 		ffx.Override(new(*snapshot.Shutter), NewSnapshot),
+
+		// http
+		ffx.Override(invokeHTTP, RegisterHTTP),
 	)
 }
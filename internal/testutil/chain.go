@@ -0,0 +1,123 @@
+// Package testutil builds the chain fixtures shared by the tests
+package testutil
+
+import (
+	"bytes"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	typegen "github.com/whyrusleeping/cbor-gen"
+	"testing"
+)
+
+// Object returns a raw block standing for the messages, receipts or state of a tipset
+func Object(t testing.TB, data ...byte) blocks.Block {
+	t.Helper()
+
+	c, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   uint64(multicodec.Sha2_256),
+		MhLength: -1,
+	}.Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blk
+}
+
+// Node returns a dag-cbor block linking to links, standing for a node of a state tree
+func Node(t testing.TB, tag uint64, links ...cid.Cid) blocks.Block {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := typegen.WriteMajorTypeHeader(&buf, typegen.MajArray, uint64(len(links)+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := typegen.WriteMajorTypeHeader(&buf, typegen.MajUnsignedInt, tag); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range links {
+		if err := typegen.WriteCid(&buf, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := abi.CidBuilder.Sum(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := blocks.NewBlockWithCid(buf.Bytes(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blk
+}
+
+// TipSet builds a single block tipset at height h on top of parents, and the messages,
+// receipts and state objects its header links to
+func TipSet(t testing.TB, h int, parents []cid.Cid) (*types.TipSet, []blocks.Block) {
+	t.Helper()
+
+	miner, err := address.NewIDAddress(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := Object(t, 'm', byte(h), byte(h>>8))
+	rcpts := Object(t, 'r', byte(h), byte(h>>8))
+	state := Object(t, 's', byte(h), byte(h>>8))
+
+	ts, err := types.NewTipSet([]*types.BlockHeader{{
+		Miner:                 miner,
+		Ticket:                &types.Ticket{VRFProof: []byte{byte(h), byte(h >> 8)}},
+		Parents:               parents,
+		ParentWeight:          types.NewInt(uint64(h)),
+		Height:                abi.ChainEpoch(h),
+		ParentStateRoot:       state.Cid(),
+		ParentMessageReceipts: rcpts.Cid(),
+		Messages:              msgs.Cid(),
+		Timestamp:             uint64(h),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts, []blocks.Block{msgs, rcpts, state}
+}
+
+// Chain builds a chain of single block tipsets at heights 1 to n, and the objects their
+// headers link to
+func Chain(t testing.TB, n int) ([]*types.TipSet, map[cid.Cid][]blocks.Block) {
+	t.Helper()
+
+	var chain []*types.TipSet
+	objects := map[cid.Cid][]blocks.Block{}
+	var parents []cid.Cid
+	for h := 1; h <= n; h++ {
+		ts, objs := TipSet(t, h, parents)
+		chain = append(chain, ts)
+		objects[ts.Cids()[0]] = objs
+		parents = ts.Cids()
+	}
+	return chain, objects
+}
+
+// Fork returns a sibling of the single block tipset ts, on the same parents with another ticket
+func Fork(t testing.TB, ts *types.TipSet) *types.TipSet {
+	t.Helper()
+
+	header := *ts.Blocks()[0]
+	header.Ticket = &types.Ticket{VRFProof: append([]byte{'f'}, header.Ticket.VRFProof...)}
+	fork, err := types.NewTipSet([]*types.BlockHeader{&header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fork
+}
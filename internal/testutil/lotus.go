@@ -0,0 +1,126 @@
+package testutil
+
+import (
+	"context"
+	"github.com/filecoin-project/lotus/api/v0api"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+	"sync"
+)
+
+// FullNode serves the tipsets and objects it holds the way a lotus node does, the methods it
+// does not implement panic
+type FullNode struct {
+	v0api.FullNode
+
+	mu      sync.Mutex
+	head    *types.TipSet
+	tipsets map[types.TipSetKey]*types.TipSet
+	objects map[cid.Cid]blocks.Block
+	err     error
+}
+
+func NewFullNode() *FullNode {
+	return &FullNode{
+		tipsets: map[types.TipSetKey]*types.TipSet{},
+		objects: map[cid.Cid]blocks.Block{},
+	}
+}
+
+// Add serves ts and its objects, ts becomes the head when it is the heaviest one
+func (f *FullNode) Add(ts *types.TipSet, objects ...blocks.Block) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tipsets[ts.Key()] = ts
+	f.addObjects(objects)
+	if f.head == nil || ts.ParentWeight().GreaterThan(f.head.ParentWeight()) {
+		f.head = ts
+	}
+}
+
+// AddObjects serves objects
+func (f *FullNode) AddObjects(objects ...blocks.Block) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.addObjects(objects)
+}
+
+// addObjects serves objects, the caller holds the lock
+func (f *FullNode) addObjects(objects []blocks.Block) {
+	for _, obj := range objects {
+		f.objects[obj.Cid()] = obj
+	}
+}
+
+// AddChain serves the tipsets of chain and their objects
+func (f *FullNode) AddChain(chain []*types.TipSet, objects map[cid.Cid][]blocks.Block) {
+	for _, ts := range chain {
+		for _, c := range ts.Cids() {
+			f.Add(ts, objects[c]...)
+		}
+	}
+}
+
+// SetHead sets the head returned by ChainHead
+func (f *FullNode) SetHead(ts *types.TipSet) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tipsets[ts.Key()] = ts
+	f.head = ts
+}
+
+// Fail makes every call fail with err, nil restores the node
+func (f *FullNode) Fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
+
+func (f *FullNode) ChainHead(context.Context) (*types.TipSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.head == nil {
+		return nil, xerrors.Errorf("no head")
+	}
+	return f.head, nil
+}
+
+func (f *FullNode) ChainGetTipSet(_ context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	ts, ok := f.tipsets[tsk]
+	if !ok {
+		return nil, xerrors.Errorf("tipset %s not found", tsk)
+	}
+	return ts, nil
+}
+
+func (f *FullNode) ChainReadObj(_ context.Context, c cid.Cid) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	obj, ok := f.objects[c]
+	if !ok {
+		return nil, xerrors.Errorf("object %s not found", c)
+	}
+	return obj.RawData(), nil
+}
+
+var _ v0api.FullNode = (*FullNode)(nil)
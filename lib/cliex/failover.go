@@ -0,0 +1,391 @@
+package cliex
+
+import (
+	"context"
+	"errors"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v0api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"golang.org/x/xerrors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const defaultHealthCheckInterval = 10 * time.Second
+
+// Dialer connects to one lotus node of a Failover
+type Dialer struct {
+	Name string
+	Dial func(context.Context) (v0api.FullNode, jsonrpc.ClientCloser, error)
+}
+
+type failoverNode struct {
+	Dialer
+
+	full    v0api.FullNode
+	closer  jsonrpc.ClientCloser
+	head    *types.TipSet
+	healthy bool
+}
+
+// Failover routes lotus api calls to the active node out of several. The active node is kept
+// while it is healthy and within maxLag epochs of the heaviest head, otherwise the healthy
+// node with the heaviest head takes over.
+type Failover struct {
+	nodes    []*failoverNode
+	interval time.Duration
+	maxLag   abi.ChainEpoch
+
+	mu     sync.RWMutex
+	active int
+	// switched is closed when the active node changes
+	switched chan struct{}
+
+	proxy v0api.FullNodeStruct
+}
+
+// NewFailover dials the nodes and selects the active one, nodes failing to dial are retried
+// on every health check
+func NewFailover(ctx context.Context, dialers []Dialer, interval time.Duration, maxLag abi.ChainEpoch) (*Failover, error) {
+	if len(dialers) == 0 {
+		return nil, xerrors.Errorf("no lotus endpoints")
+	}
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	f := &Failover{
+		interval: interval,
+		maxLag:   maxLag,
+		active:   -1,
+		switched: make(chan struct{}),
+	}
+	for _, d := range dialers {
+		f.nodes = append(f.nodes, &failoverNode{Dialer: d})
+	}
+
+	f.check(ctx)
+	if f.current() < 0 {
+		return nil, xerrors.Errorf("no healthy lotus endpoint out of %d", len(dialers))
+	}
+
+	f.buildProxy()
+
+	return f, nil
+}
+
+// FullNode returns the api routed to the active node
+func (f *Failover) FullNode() v0api.FullNode {
+	return &f.proxy
+}
+
+// Run checks the health of the nodes every interval until ctx is done
+func (f *Failover) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f.check(ctx)
+		}
+	}
+}
+
+func (f *Failover) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, n := range f.nodes {
+		if n.closer != nil {
+			n.closer()
+		}
+	}
+}
+
+func (f *Failover) current() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.active
+}
+
+// check polls the head of every node and selects the active one
+func (f *Failover) check(ctx context.Context) {
+	type result struct {
+		full   v0api.FullNode
+		closer jsonrpc.ClientCloser
+		head   *types.TipSet
+		err    error
+	}
+
+	// probe without holding the lock, so calls are routed meanwhile
+	f.mu.RLock()
+	fulls := make([]v0api.FullNode, len(f.nodes))
+	for i, n := range f.nodes {
+		fulls[i] = n.full
+	}
+	f.mu.RUnlock()
+
+	results := make([]result, len(f.nodes))
+	var wg sync.WaitGroup
+	for i, n := range f.nodes {
+		i, n, full := i, n, fulls[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			cctx, cancel := context.WithTimeout(ctx, f.interval)
+			defer cancel()
+
+			if full == nil {
+				var err error
+				full, results[i].closer, err = n.dial(ctx, cctx)
+				if err != nil {
+					results[i].err = xerrors.Errorf("dial: %w", err)
+					return
+				}
+				results[i].full = full
+			}
+
+			results[i].head, results[i].err = full.ChainHead(cctx)
+		}()
+	}
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	best := -1
+	for i, n := range f.nodes {
+		res := results[i]
+		if res.full != nil {
+			n.full, n.closer = res.full, res.closer
+		}
+		if res.err != nil {
+			if n.healthy {
+				log.Warnw("lotus endpoint unhealthy", "endpoint", n.Name, "err", res.err)
+			}
+			n.healthy = false
+			continue
+		}
+		if !n.healthy {
+			log.Infow("lotus endpoint healthy", "endpoint", n.Name, "height", res.head.Height())
+		}
+		n.healthy = true
+		n.head = res.head
+
+		if best < 0 || n.head.ParentWeight().GreaterThan(f.nodes[best].head.ParentWeight()) {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		log.Error("no healthy lotus endpoint")
+		return
+	}
+
+	if f.active >= 0 {
+		cur := f.nodes[f.active]
+		if cur.healthy && cur.head.Height()+f.maxLag >= f.nodes[best].head.Height() {
+			return
+		}
+	}
+
+	f.activate(best)
+}
+
+// dial connects to the node within the probe deadline of cctx. The client lives as long as ctx,
+// the jsonrpc client stops serving once the context it was dialed with is done; a connection
+// made after the deadline is closed.
+func (n *failoverNode) dial(ctx, cctx context.Context) (v0api.FullNode, jsonrpc.ClientCloser, error) {
+	type dialed struct {
+		full   v0api.FullNode
+		closer jsonrpc.ClientCloser
+		err    error
+	}
+
+	ch := make(chan dialed, 1)
+	go func() {
+		full, closer, err := n.Dial(ctx)
+		ch <- dialed{full, closer, err}
+	}()
+
+	select {
+	case d := <-ch:
+		return d.full, d.closer, d.err
+	case <-cctx.Done():
+		go func() {
+			if d := <-ch; d.err == nil {
+				d.closer()
+			}
+		}()
+		return nil, nil, cctx.Err()
+	}
+}
+
+// activate switches the active node, the caller holds the lock
+func (f *Failover) activate(i int) {
+	if f.active == i {
+		return
+	}
+
+	from := "none"
+	if f.active >= 0 {
+		from = f.nodes[f.active].Name
+	}
+	log.Infow("switching lotus endpoint", "from", from, "to", f.nodes[i].Name, "height", f.nodes[i].head.Height())
+
+	f.active = i
+	close(f.switched)
+	f.switched = make(chan struct{})
+}
+
+// markUnhealthy fails over from a node whose call failed on the connection, it reports whether
+// a healthy node is active to retry the call on
+func (f *Failover) markUnhealthy(i int, err error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.nodes[i]
+	if n.healthy {
+		log.Warnw("lotus endpoint unhealthy", "endpoint", n.Name, "err", err)
+	}
+	n.healthy = false
+
+	if f.active == i {
+		best := -1
+		for j, n := range f.nodes {
+			if !n.healthy {
+				continue
+			}
+			if best < 0 || n.head.ParentWeight().GreaterThan(f.nodes[best].head.ParentWeight()) {
+				best = j
+			}
+		}
+		if best >= 0 {
+			f.activate(best)
+		}
+	}
+
+	return f.active >= 0 && f.nodes[f.active].healthy
+}
+
+// route returns the active node and the channel closed when it is replaced
+func (f *Failover) route() (int, v0api.FullNode, <-chan struct{}) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.active < 0 {
+		return -1, nil, f.switched
+	}
+	return f.active, f.nodes[f.active].full, f.switched
+}
+
+// connError reports whether err is a failure to reach the node rather than an api error
+func connError(err error) bool {
+	var rce *jsonrpc.RPCConnectionError
+	var ec *jsonrpc.ErrClient
+	return errors.As(err, &rce) || errors.As(err, &ec)
+}
+
+// buildProxy fills the methods of the proxy with calls to the active node, a call failing on
+// the connection is retried once on every other healthy node and fails once none is left
+func (f *Failover) buildProxy() {
+	for _, out := range api.GetInternalStructs(&f.proxy) {
+		rint := reflect.ValueOf(out).Elem()
+
+		for i := 0; i < rint.NumField(); i++ {
+			field := rint.Type().Field(i)
+			name := field.Name
+			ftyp := field.Type
+
+			rint.Field(i).Set(reflect.MakeFunc(ftyp, func(args []reflect.Value) []reflect.Value {
+				var res []reflect.Value
+				for tries := 0; tries < len(f.nodes); tries++ {
+					idx, full, _ := f.route()
+					if full == nil {
+						break
+					}
+
+					res = reflect.ValueOf(full).MethodByName(name).Call(args)
+					errv := res[len(res)-1]
+					if errv.IsNil() || !connError(errv.Interface().(error)) {
+						return res
+					}
+					if !f.markUnhealthy(idx, errv.Interface().(error)) {
+						break
+					}
+				}
+				if res != nil {
+					return res
+				}
+
+				return errResults(ftyp, xerrors.Errorf("no healthy lotus endpoint"))
+			}))
+		}
+	}
+
+	f.proxy.Internal.ChainNotify = f.chainNotify
+}
+
+// chainNotify subscribes to the active node and closes the subscription when the active
+// node changes, so the head notifier resubscribes to the new one
+func (f *Failover) chainNotify(ctx context.Context) (<-chan []*api.HeadChange, error) {
+	idx, full, switched := f.route()
+	if full == nil {
+		return nil, xerrors.Errorf("no healthy lotus endpoint")
+	}
+
+	nctx, cancel := context.WithCancel(ctx)
+	in, err := full.ChainNotify(nctx)
+	if err != nil {
+		cancel()
+		if connError(err) {
+			f.markUnhealthy(idx, err)
+		}
+		return nil, err
+	}
+
+	out := make(chan []*api.HeadChange)
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		for {
+			select {
+			case <-switched:
+				return
+			case <-ctx.Done():
+				return
+			case changes, ok := <-in:
+				if !ok {
+					return
+				}
+				select {
+				case out <- changes:
+				case <-switched:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// errResults builds the results of a method of type ftyp returning err
+func errResults(ftyp reflect.Type, err error) []reflect.Value {
+	res := make([]reflect.Value, ftyp.NumOut())
+	for i := 0; i < len(res)-1; i++ {
+		res[i] = reflect.Zero(ftyp.Out(i))
+	}
+	res[len(res)-1] = reflect.ValueOf(&err).Elem()
+	return res
+}
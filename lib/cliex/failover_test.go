@@ -0,0 +1,155 @@
+package cliex
+
+import (
+	"context"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api/v0api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/snapshot_snake/internal/testutil"
+	"golang.org/x/xerrors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countNode counts the head calls it serves
+type countNode struct {
+	*testutil.FullNode
+	calls atomic.Int64
+}
+
+func (n *countNode) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	n.calls.Add(1)
+	return n.FullNode.ChainHead(ctx)
+}
+
+func newCountNode(head *types.TipSet) *countNode {
+	n := &countNode{FullNode: testutil.NewFullNode()}
+	n.SetHead(head)
+	return n
+}
+
+// newTestFailover fails over between the nodes, a nil node fails to dial. The health checks
+// are run by the tests.
+func newTestFailover(t *testing.T, maxLag int, nodes ...*countNode) *Failover {
+	t.Helper()
+
+	var dialers []Dialer
+	for i, n := range nodes {
+		n := n
+		dialers = append(dialers, Dialer{
+			Name: string(rune('a' + i)),
+			Dial: func(context.Context) (v0api.FullNode, jsonrpc.ClientCloser, error) {
+				if n == nil {
+					return nil, nil, xerrors.New("connection refused")
+				}
+				return n, func() {}, nil
+			},
+		})
+	}
+
+	f, err := NewFailover(context.Background(), dialers, time.Hour, abi.ChainEpoch(maxLag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestFailoverConnError(t *testing.T) {
+	ctx := context.Background()
+	chain, _ := testutil.Chain(t, 10)
+	a, b := newCountNode(chain[9]), newCountNode(chain[7])
+	f := newTestFailover(t, 0, a, b)
+	full := f.FullNode()
+
+	if got := f.current(); got != 0 {
+		t.Fatalf("active node %d, want the heaviest one", got)
+	}
+
+	// api errors are returned as is
+	a.Fail(xerrors.New("api error"))
+	if _, err := full.ChainHead(ctx); err == nil {
+		t.Fatal("api error not returned")
+	}
+	if got := f.current(); got != 0 {
+		t.Fatalf("active node %d after an api error", got)
+	}
+
+	// connection errors are retried on the next node
+	a.Fail(&jsonrpc.RPCConnectionError{})
+	head, err := full.ChainHead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != chain[7] {
+		t.Fatalf("head at height %d, want %d", head.Height(), chain[7].Height())
+	}
+	if got := f.current(); got != 1 {
+		t.Fatalf("active node %d, want the healthy one", got)
+	}
+}
+
+func TestFailoverLag(t *testing.T) {
+	ctx := context.Background()
+	chain, _ := testutil.Chain(t, 20)
+	a, b := newCountNode(chain[9]), newCountNode(chain[8])
+	f := newTestFailover(t, 2, a, b)
+
+	if got := f.current(); got != 0 {
+		t.Fatalf("active node %d, want the heaviest one", got)
+	}
+
+	// within the lag the active node is kept
+	b.SetHead(chain[11])
+	f.check(ctx)
+	if got := f.current(); got != 0 {
+		t.Fatalf("active node %d switched within the lag", got)
+	}
+
+	b.SetHead(chain[12])
+	f.check(ctx)
+	if got := f.current(); got != 1 {
+		t.Fatalf("active node %d, want the one ahead", got)
+	}
+
+	// an unhealthy active node is replaced regardless of the lag
+	b.Fail(&jsonrpc.RPCConnectionError{})
+	f.check(ctx)
+	if got := f.current(); got != 0 {
+		t.Fatalf("active node %d, want the healthy one", got)
+	}
+}
+
+func TestFailoverNoHealthyNode(t *testing.T) {
+	ctx := context.Background()
+	chain, _ := testutil.Chain(t, 10)
+	a, b := newCountNode(chain[9]), newCountNode(chain[8])
+	b.Fail(&jsonrpc.RPCConnectionError{})
+	f := newTestFailover(t, 0, a, b, nil)
+
+	a.Fail(&jsonrpc.RPCConnectionError{})
+	a.calls.Store(0)
+	b.calls.Store(0)
+	if _, err := f.FullNode().ChainHead(ctx); err == nil {
+		t.Fatal("call succeeded without a healthy node")
+	}
+	if got := a.calls.Load(); got != 1 {
+		t.Fatalf("dead node called %d times, want 1", got)
+	}
+	if got := b.calls.Load(); got != 0 {
+		t.Fatalf("unhealthy node called %d times", got)
+	}
+
+	// the health check brings the recovered node back
+	b.Fail(nil)
+	f.check(ctx)
+	head, err := f.FullNode().ChainHead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != chain[8] {
+		t.Fatalf("head at height %d, want %d", head.Height(), chain[8].Height())
+	}
+}
@@ -0,0 +1,92 @@
+package cliex
+
+import (
+	"context"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v0api"
+	"github.com/filecoin-project/lotus/chain/store"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/snapshot_snake/common"
+	"time"
+)
+
+// NewHeadPoll builds a head notifier polling ChainHead every interval, for lotus endpoints
+// without websocket ChainNotify support
+func NewHeadPoll(full v0api.FullNode, interval time.Duration) (*HeadPoll, error) {
+	if interval <= 0 {
+		interval = nonChanModeInterval
+	}
+
+	return &HeadPoll{
+		full:     full,
+		interval: interval,
+	}, nil
+}
+
+type HeadPoll struct {
+	connStatus
+
+	full     v0api.FullNode
+	interval time.Duration
+}
+
+func (h *HeadPoll) GetTipSet(ctx context.Context, tsk <-chan common.HeadChange, tsCh chan *api.HeadChange) {
+	loadTipSets(ctx, h.full, tsk, tsCh)
+}
+
+func (h *HeadPoll) Sub(ctx context.Context) (<-chan common.HeadChange, error) {
+	ch := make(chan common.HeadChange, 1)
+	go h.poll(ctx, ch)
+	return ch, nil
+}
+
+func (h *HeadPoll) poll(ctx context.Context, tx chan common.HeadChange) {
+	log.Infow("head poll loop start", "interval", h.interval)
+	defer log.Info("head poll loop stop")
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	sender := newChangeSender(tx, sendDelay)
+	go sender.run(ctx)
+
+	var last *types.TipSet
+	for {
+		head, err := h.full.ChainHead(ctx)
+		if err != nil {
+			log.Errorf("failed to poll chain head: %s", err)
+			h.setDisconnected(err)
+		} else {
+			h.setConnected()
+
+			changes, err := h.diff(ctx, last, head)
+			if err != nil {
+				log.Errorf("failed to diff chain head: %s", err)
+			} else {
+				last = head
+				if len(changes) > 0 {
+					sender.push(changes)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// diff returns the head changes from the last seen head to the new one, reverts included
+// when the chain reorged
+func (h *HeadPoll) diff(ctx context.Context, last, head *types.TipSet) ([]*api.HeadChange, error) {
+	if last == nil {
+		return []*api.HeadChange{{Type: store.HCCurrent, Val: head}}, nil
+	}
+	if last.Key() == head.Key() {
+		return nil, nil
+	}
+
+	return h.full.ChainGetPath(ctx, last.Key(), head.Key())
+}
@@ -5,8 +5,12 @@ import (
 	"github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/api/v0api"
 	"github.com/filecoin-project/lotus/chain/store"
-	"github.com/filecoin-project/lotus/chain/types"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/lib/metrics"
+	"go.opencensus.io/stats"
+	"golang.org/x/xerrors"
+	"sync"
 	"time"
 )
 
@@ -17,6 +21,9 @@ const (
 	maxReListenInterval = 10 * time.Second
 
 	nonChanModeInterval = 10 * time.Second
+
+	// sendDelay is the time an applied tipset waits for the chain to settle before it is sent
+	sendDelay = 5 * time.Second
 )
 
 func NewHeadSub(full v0api.FullNode) (*HeadSub, error) {
@@ -27,108 +34,278 @@ func NewHeadSub(full v0api.FullNode) (*HeadSub, error) {
 }
 
 type HeadSub struct {
+	connStatus
+
 	full     v0api.FullNode
 	interval time.Duration
 }
 
-func (h *HeadSub) GetTipSet(ctx context.Context, tsk <-chan types.TipSetKey, tsCh chan *types.TipSet) {
+// connStatus tracks the connection state of a head notifier
+type connStatus struct {
+	mu     sync.Mutex
+	status common.NotifierStatus
+	// connected is set once the first connection succeeded
+	connected bool
+}
+
+func (c *connStatus) Status() common.NotifierStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// setConnected records a successful connection
+func (c *connStatus) setConnected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.status.Connected {
+		return
+	}
+	if c.connected {
+		c.status.Reconnects++
+		stats.Record(context.Background(), metrics.HeadReconnects.M(1))
+	}
+	c.connected = true
+	c.status.Connected = true
+	c.status.Since = time.Now()
+}
+
+// setDisconnected records a lost or failed connection
+func (c *connStatus) setDisconnected(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.status.Connected || c.status.Since.IsZero() {
+		c.status.Since = time.Now()
+	}
+	c.status.Connected = false
+	c.status.LastError = err.Error()
+}
+
+// backoff waits the current re-listen interval and doubles it up to maxReListenInterval,
+// it returns false when ctx is done
+func (h *HeadSub) backoff(ctx context.Context) bool {
+	h.mu.Lock()
+	wait := h.interval
+	h.interval *= 2
+	if h.interval > maxReListenInterval {
+		h.interval = maxReListenInterval
+	}
+	h.mu.Unlock()
+
+	log.Infof("re-listen chain notify in %s", wait)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (h *HeadSub) GetTipSet(ctx context.Context, tsk <-chan common.HeadChange, tsCh chan *api.HeadChange) {
+	loadTipSets(ctx, h.full, tsk, tsCh)
+}
+
+// loadTipSets loads the tipsets of the head changes from lotus and forwards them
+func loadTipSets(ctx context.Context, full v0api.FullNode, tsk <-chan common.HeadChange, tsCh chan *api.HeadChange) {
 	for {
 		select {
 		case <-ctx.Done():
 			log.Infof("stop load tipset")
 			return
-		case tipSetKey := <-tsk:
-			rawTipSet, err := h.full.ChainGetTipSet(ctx, tipSetKey)
+		case change := <-tsk:
+			rawTipSet, err := full.ChainGetTipSet(ctx, change.Key)
 			if err != nil {
+				// the shutter re-ingests the tipset when it fills the gap
 				log.Errorf("failed to get tipset: %s", err)
-				return
+				continue
 			}
 
-			tsCh <- rawTipSet
+			tsCh <- &api.HeadChange{
+				Type: change.Type,
+				Val:  rawTipSet,
+			}
 		}
 	}
 }
 
-func (h *HeadSub) Sub(ctx context.Context) (<-chan types.TipSetKey, error) {
-	ch := make(chan types.TipSetKey, 1)
+func (h *HeadSub) Sub(ctx context.Context) (<-chan common.HeadChange, error) {
+	ch := make(chan common.HeadChange, 1)
 	go h.watch(ctx, ch)
 	return ch, nil
 }
 
-func (h *HeadSub) watch(ctx context.Context, tx chan types.TipSetKey) {
+func (h *HeadSub) watch(ctx context.Context, tx chan common.HeadChange) {
 	log.Info("head change loop start")
 	defer log.Info("head change loop stop")
 
-	ch, err := h.full.ChainNotify(ctx)
-	if err != nil {
-		log.Fatalf("failed to get chain notify channel: %s", err)
-		return
+	sender := newChangeSender(tx, sendDelay)
+	go sender.run(ctx)
+
+	for {
+		ch, err := h.full.ChainNotify(ctx)
+		if err != nil {
+			log.Errorf("failed to get chain notify channel: %s", err)
+			h.setDisconnected(err)
+			if !h.backoff(ctx) {
+				return
+			}
+			continue
+		}
+
+		// the first notification of a subscription is the current head, so the head is
+		// emitted again on every reconnect
+		h.setConnected()
+		h.mu.Lock()
+		h.interval = minReListenInterval
+		h.mu.Unlock()
+		log.Info("chain notify subscribed")
+
+		if !h.listen(ctx, sender, ch) {
+			return
+		}
+
+		log.Error("failed to get chain head update, chain notify channel closed")
+		h.setDisconnected(xerrors.New("chain notify channel closed"))
+		if !h.backoff(ctx) {
+			return
+		}
 	}
-	cancel := context.CancelFunc(func() {})
+}
 
+// listen forwards the head changes of a subscription until its channel closes, it returns
+// false when ctx is done
+func (h *HeadSub) listen(ctx context.Context, sender *changeSender, ch <-chan []*api.HeadChange) bool {
 	for {
 		select {
 		case <-ctx.Done():
-			cancel()
-			return
+			return false
 		case changes, ok := <-ch:
 			if !ok {
-				log.Error("failed to get chain head update")
-				return
+				return true
 			}
-			cancel()
-
-			applyCtx, applyCancel := context.WithCancel(ctx)
-			cancel = applyCancel
-			h.applyChanges(applyCtx, tx, changes)
+			sender.push(changes)
 		}
 	}
 }
 
-func (h *HeadSub) applyChanges(ctx context.Context, tx chan types.TipSetKey, changes []*api.HeadChange) {
-	idx := -1
+// changeSender forwards the head changes in order from a single goroutine. Reverts are never
+// dropped; an applied tipset is sent after the delay, unless a later one supersedes it, the
+// shutter catches up the tipsets in between.
+type changeSender struct {
+	tx    chan common.HeadChange
+	delay time.Duration
+
+	mu      sync.Mutex
+	pending []common.HeadChange
+	// due is when the pending applied tipset is sent
+	due    time.Time
+	notify chan struct{}
+}
+
+func newChangeSender(tx chan common.HeadChange, delay time.Duration) *changeSender {
+	return &changeSender{
+		tx:     tx,
+		delay:  delay,
+		notify: make(chan struct{}, 1),
+	}
+}
 
+// push queues the reverts and the last applied tipset of the changes
+func (s *changeSender) push(changes []*api.HeadChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := -1
 	for i := range changes {
 		switch changes[i].Type {
+		case store.HCRevert:
+			// reverts are forwarded in order, so reverted tipsets get unlinked
+			s.pending = append(s.pending, common.HeadChange{
+				Type: store.HCRevert,
+				Key:  changes[i].Val.Key(),
+			})
 		case store.HCCurrent, store.HCApply:
 			idx = i
 		}
 	}
 
-	if idx == -1 {
-		return
+	if idx != -1 {
+		kept := s.pending[:0]
+		for _, change := range s.pending {
+			if change.Type == store.HCRevert {
+				kept = append(kept, change)
+			}
+		}
+		s.pending = append(kept, common.HeadChange{
+			Type: changes[idx].Type,
+			Key:  changes[idx].Val.Key(),
+		})
+		s.due = time.Now().Add(s.delay)
 	}
 
-	tsk := changes[idx].Val.Key()
-	go delaySend(ctx, tx, tsk)
-}
-
-func delaySend(ctx context.Context, ch chan types.TipSetKey, tsk types.TipSetKey) {
-	slog := log.With("tsk", tsk)
-
-	timer := time.NewTimer(5 * time.Second)
-	defer timer.Stop()
-
 	select {
-	case <-ctx.Done():
-		slog.Debug("aborted")
-		return
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
 
-	case <-timer.C:
+// next pops the change to send, or returns how long the pending applied tipset still waits
+func (s *changeSender) next() (*common.HeadChange, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	if len(s.pending) == 0 {
+		return nil, -1
 	}
+	change := s.pending[0]
+	if change.Type != store.HCRevert {
+		if wait := time.Until(s.due); wait > 0 {
+			return nil, wait
+		}
+	}
+	s.pending = s.pending[1:]
+	return &change, 0
+}
 
-	wait := time.NewTimer(time.Second)
-	defer wait.Stop()
-
-	select {
-	case <-ctx.Done():
-		slog.Debug("aborted")
+// run sends the queued changes until ctx is done, the sends block until the changes are
+// received
+func (s *changeSender) run(ctx context.Context) {
+	for {
+		change, wait := s.next()
+		if change == nil {
+			var timeout <-chan time.Time
+			var timer *time.Timer
+			if wait > 0 {
+				timer = time.NewTimer(wait)
+				timeout = timer.C
+			}
 
-	case ch <- tsk:
-		slog.Debug("sent")
+			select {
+			case <-ctx.Done():
+			case <-s.notify:
+			case <-timeout:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
 
-	case <-wait.C:
-		slog.Debug("out chan is full")
+		select {
+		case <-ctx.Done():
+			log.Debugw("aborted", "tsk", change.Key)
+			return
+		case s.tx <- *change:
+			log.Debugw("sent", "type", change.Type, "tsk", change.Key)
+		}
 	}
 }
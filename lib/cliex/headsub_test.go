@@ -0,0 +1,56 @@
+package cliex
+
+import (
+	"context"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/store"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/internal/testutil"
+	"testing"
+	"time"
+)
+
+func TestChangeSenderOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tx := make(chan common.HeadChange)
+	sender := newChangeSender(tx, 200*time.Millisecond)
+	go sender.run(ctx)
+
+	tipset := func(h int) *types.TipSet {
+		ts, _ := testutil.TipSet(t, h, nil)
+		return ts
+	}
+	a1, a2, a3 := tipset(1), tipset(2), tipset(3)
+	r1, r2 := tipset(11), tipset(12)
+
+	recv := func(want common.HeadChange) {
+		t.Helper()
+		select {
+		case got := <-tx:
+			if got != want {
+				t.Fatalf("got %s %s, want %s %s", got.Type, got.Key, want.Type, want.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s %s not received", want.Type, want.Key)
+		}
+	}
+
+	// a1 is superseded by a2 before it is due, r1 is sent right away
+	sender.push([]*api.HeadChange{{Type: store.HCApply, Val: a1}})
+	sender.push([]*api.HeadChange{{Type: store.HCRevert, Val: r1}, {Type: store.HCApply, Val: a2}})
+	recv(common.HeadChange{Type: store.HCRevert, Key: r1.Key()})
+
+	// a2 is superseded by a3 while it waits, r2 is kept
+	sender.push([]*api.HeadChange{{Type: store.HCRevert, Val: r2}, {Type: store.HCApply, Val: a3}})
+	recv(common.HeadChange{Type: store.HCRevert, Key: r2.Key()})
+	recv(common.HeadChange{Type: store.HCApply, Key: a3.Key()})
+
+	select {
+	case got := <-tx:
+		t.Fatalf("unexpected change %s %s", got.Type, got.Key)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
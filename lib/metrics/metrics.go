@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"contrib.go.opencensus.io/exporter/prometheus"
+	logging "github.com/ipfs/go-log/v2"
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"net/http"
+)
+
+var log = logging.Logger("metrics")
+
+// Path is the path the metrics are served under
+const Path = "/metrics"
+
+var (
+	// ExportKind is "full" or "diff"
+	ExportKind, _ = tag.NewKey("kind")
+)
+
+// ingestion
+var (
+	IngestHeight   = stats.Int64("ingest/height", "Height of the last ingested tipset", stats.UnitDimensionless)
+	IngestTipsets  = stats.Int64("ingest/tipsets", "Counter of ingested tipsets", stats.UnitDimensionless)
+	SourceHeights  = stats.Int64("source/heights", "Number of heights in the snapshot source", stats.UnitDimensionless)
+	DagNodes       = stats.Int64("dag/nodes", "Number of nodes linked in the dag", stats.UnitDimensionless)
+	DagRefs        = stats.Int64("dag/refs", "Sum of the reference counts of the dag", stats.UnitDimensionless)
+	HeadReconnects = stats.Int64("head/reconnects", "Counter of head notifier reconnects", stats.UnitDimensionless)
+	GCNodes        = stats.Int64("gc/nodes", "Counter of dag nodes reclaimed by the gc", stats.UnitDimensionless)
+	GCBlocks       = stats.Int64("gc/blocks", "Counter of headers deleted from the cache by the gc", stats.UnitDimensionless)
+	GCObjects      = stats.Int64("gc/objects", "Counter of objects out of the window deleted from the cache by the gc", stats.UnitDimensionless)
+)
+
+// cache
+var (
+	CacheSize       = stats.Int64("cache/size", "Number of blocks in the block cache", stats.UnitDimensionless)
+	CacheBytes      = stats.Int64("cache/bytes", "Bytes of block data in the block cache", stats.UnitBytes)
+	CacheHits       = stats.Int64("cache/hits", "Counter of block cache hits", stats.UnitDimensionless)
+	CacheMisses     = stats.Int64("cache/misses", "Counter of block cache misses", stats.UnitDimensionless)
+	CacheEvictions  = stats.Int64("cache/evictions", "Counter of blocks evicted from the block cache", stats.UnitDimensionless)
+	CacheSpills     = stats.Int64("cache/spills", "Counter of evicted blocks written to the disk tier", stats.UnitDimensionless)
+	CachePromotions = stats.Int64("cache/promotions", "Counter of blocks read back from the disk tier into memory", stats.UnitDimensionless)
+)
+
+// exports
+var (
+	ExportDuration = stats.Float64("export/duration_ms", "Duration of snapshot exports", stats.UnitMilliseconds)
+	ExportBytes    = stats.Int64("export/bytes", "Counter of bytes written by snapshot exports", stats.UnitBytes)
+	ExportBlocks   = stats.Int64("export/blocks", "Counter of blocks written by snapshot exports", stats.UnitDimensionless)
+)
+
+var (
+	IngestHeightView   = &view.View{Measure: IngestHeight, Aggregation: view.LastValue()}
+	IngestTipsetsView  = &view.View{Measure: IngestTipsets, Aggregation: view.Count()}
+	SourceHeightsView  = &view.View{Measure: SourceHeights, Aggregation: view.LastValue()}
+	DagNodesView       = &view.View{Measure: DagNodes, Aggregation: view.LastValue()}
+	DagRefsView        = &view.View{Measure: DagRefs, Aggregation: view.LastValue()}
+	HeadReconnectsView = &view.View{Measure: HeadReconnects, Aggregation: view.Sum()}
+	GCNodesView        = &view.View{Measure: GCNodes, Aggregation: view.Sum()}
+	GCBlocksView       = &view.View{Measure: GCBlocks, Aggregation: view.Sum()}
+	GCObjectsView      = &view.View{Measure: GCObjects, Aggregation: view.Sum()}
+
+	CacheSizeView       = &view.View{Measure: CacheSize, Aggregation: view.LastValue()}
+	CacheBytesView      = &view.View{Measure: CacheBytes, Aggregation: view.LastValue()}
+	CacheHitsView       = &view.View{Measure: CacheHits, Aggregation: view.Sum()}
+	CacheMissesView     = &view.View{Measure: CacheMisses, Aggregation: view.Sum()}
+	CacheEvictionsView  = &view.View{Measure: CacheEvictions, Aggregation: view.Sum()}
+	CacheSpillsView     = &view.View{Measure: CacheSpills, Aggregation: view.Sum()}
+	CachePromotionsView = &view.View{Measure: CachePromotions, Aggregation: view.Sum()}
+
+	ExportDurationView = &view.View{
+		Measure:     ExportDuration,
+		Aggregation: view.Distribution(1e3, 5e3, 1e4, 3e4, 6e4, 3e5, 6e5, 1.8e6, 3.6e6),
+		TagKeys:     []tag.Key{ExportKind},
+	}
+	ExportBytesView  = &view.View{Measure: ExportBytes, Aggregation: view.Sum(), TagKeys: []tag.Key{ExportKind}}
+	ExportBlocksView = &view.View{Measure: ExportBlocks, Aggregation: view.Sum(), TagKeys: []tag.Key{ExportKind}}
+)
+
+// Views are all the views of the daemon
+var Views = []*view.View{
+	IngestHeightView,
+	IngestTipsetsView,
+	SourceHeightsView,
+	DagNodesView,
+	DagRefsView,
+	HeadReconnectsView,
+	GCNodesView,
+	GCBlocksView,
+	GCObjectsView,
+	CacheSizeView,
+	CacheBytesView,
+	CacheHitsView,
+	CacheMissesView,
+	CacheEvictionsView,
+	CacheSpillsView,
+	CachePromotionsView,
+	ExportDurationView,
+	ExportBytesView,
+	ExportBlocksView,
+}
+
+// Exporter registers the views and returns the prometheus handler serving them
+func Exporter() (http.Handler, error) {
+	if err := view.Register(Views...); err != nil {
+		return nil, err
+	}
+
+	// the default registerer is a *Registry, keep the go and process collectors it holds
+	registry, ok := promclient.DefaultRegisterer.(*promclient.Registry)
+	if !ok {
+		log.Warnf("unexpected type of the default prometheus registry: %T", promclient.DefaultRegisterer)
+	}
+
+	return prometheus.NewExporter(prometheus.Options{
+		Registry:  registry,
+		Namespace: "snapshot_snake",
+	})
+}
@@ -0,0 +1,96 @@
+package snapshot
+
+import (
+	"context"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+	"sync/atomic"
+	"time"
+)
+
+// Backfill walks the parents of the lotus head back the given number of epochs and links the
+// tipsets oldest first, so a full window is available without waiting for head changes. The
+// headers are linked before Backfill returns; the messages, receipts and state of the tipsets
+// are fetched in the background, parallelism tipsets at a time.
+func (s *Shutter) Backfill(ctx context.Context, epochs int64, parallelism int) error {
+	if retention := int64(s.src.Retention()); epochs > retention {
+		epochs = retention
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	head, err := s.full.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("get chain head: %w", err)
+	}
+
+	log.Infow("backfill started", "head", head.Height(), "epochs", epochs)
+
+	// collect the tipsets from the head back to the start of the window
+	stop := head.Height() - abi.ChainEpoch(epochs)
+	chain := []*types.TipSet{head}
+	for ts := head; ts.Height() > 0; {
+		parent, err := s.full.ChainGetTipSet(ctx, ts.Parents())
+		if err != nil {
+			return xerrors.Errorf("get parent tipset of height %d: %w", ts.Height(), err)
+		}
+		if parent.Height() <= stop {
+			break
+		}
+
+		chain = append(chain, parent)
+		ts = parent
+	}
+
+	s.ingest.Lock()
+	defer s.ingest.Unlock()
+
+	linked, err := s.linkChain(ctx, chain)
+	if err != nil {
+		return err
+	}
+
+	log.Infow("backfill linked headers", "tipsets", len(chain), "linked", len(linked), "oldest", chain[len(chain)-1].Height())
+
+	go s.backfillObjects(ctx, chain, parallelism)
+
+	return nil
+}
+
+// backfillObjects fetches the objects of the backfilled tipsets, logging the progress
+func (s *Shutter) backfillObjects(ctx context.Context, chain []*types.TipSet, parallelism int) {
+	s.objects.RLock()
+	defer s.objects.RUnlock()
+
+	begin := time.Now()
+	total := len(chain)
+	step := total / 20
+	if step == 0 {
+		step = 1
+	}
+
+	var done, failed int64
+
+	eg, ectx := errgroup.WithContext(ctx)
+	eg.SetLimit(parallelism)
+	for _, ts := range chain {
+		ts := ts
+		eg.Go(func() error {
+			if err := s.fetchTipSet(ectx, ts); err != nil {
+				atomic.AddInt64(&failed, 1)
+				log.Warnf("failed to backfill objects of tipset at height %d err: %s", ts.Height(), err)
+			}
+
+			if n := atomic.AddInt64(&done, 1); n%int64(step) == 0 || n == int64(total) {
+				log.Infow("backfill progress", "done", n, "total", total, "height", ts.Height(), "elapsed", time.Since(begin).String())
+			}
+			return nil
+		})
+	}
+	_ = eg.Wait()
+
+	log.Infow("backfill finished", "tipsets", total, "failed", atomic.LoadInt64(&failed), "elapsed", time.Since(begin).String())
+}
@@ -0,0 +1,138 @@
+package snapshot
+
+import (
+	"context"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/snapshot_snake/snapshot/saaf"
+	"golang.org/x/xerrors"
+)
+
+// CatchUp fills the gaps left in the source by missed head changes, fetching the missing
+// tipsets from lotus and linking them oldest first
+func (s *Shutter) CatchUp(ctx context.Context) error {
+	for _, gap := range s.src.Gaps() {
+		if err := s.fillGap(ctx, gap); err != nil {
+			return xerrors.Errorf("fill gap %d..%d: %w", gap.From, gap.To, err)
+		}
+	}
+
+	return nil
+}
+
+// fillGap walks the parents of the tipset at gap.To back to a tipset recorded in the source,
+// reverts the recorded tipsets of other forks in between and links the walked ones
+func (s *Shutter) fillGap(ctx context.Context, gap saaf.Gap) error {
+	oldest := s.src.OldestHeight()
+
+	// collect the missing tipsets, down to the anchor recorded in the source
+	var chain []*types.TipSet
+	anchor := oldest - 1
+	key := types.NewTipSetKey(gap.Parents...)
+	for {
+		ts, err := s.full.ChainGetTipSet(ctx, key)
+		if err != nil {
+			return xerrors.Errorf("get tipset %s: %w", key, err)
+		}
+		height := saaf.Height(ts.Height())
+		if height < oldest {
+			break
+		}
+		if types.NewTipSetKey(s.src.FindPointersByHeight(height)...) == ts.Key() {
+			anchor = height
+			break
+		}
+
+		chain = append(chain, ts)
+		if height == 0 {
+			break
+		}
+		key = ts.Parents()
+	}
+
+	log.Infow("filling gap", "from", gap.From, "to", gap.To, "anchor", anchor, "missing", len(chain))
+
+	// revert the tipsets between the anchor and the gap that are not on the chain of gap.To
+	onChain := make(map[types.TipSetKey]struct{}, len(chain))
+	for _, ts := range chain {
+		onChain[ts.Key()] = struct{}{}
+	}
+	for h := gap.To - 1; h > anchor; h-- {
+		cids := s.src.FindPointersByHeight(h)
+		if len(cids) == 0 {
+			continue
+		}
+		if _, ok := onChain[types.NewTipSetKey(cids...)]; ok {
+			continue
+		}
+
+		stale, err := s.sourceTipSet(cids)
+		if err != nil {
+			log.Warnf("failed to load stale tipset at height %d err: %s", h, err)
+			continue
+		}
+		log.Infow("reverting stale tipset", "height", h, "tipset", stale)
+		if err := s.Revert(ctx, stale); err != nil {
+			return err
+		}
+	}
+
+	linked, err := s.linkChain(ctx, chain)
+	if err != nil {
+		return err
+	}
+	fresh := cid.NewSet()
+	for _, ts := range linked {
+		for _, c := range ts.Cids() {
+			fresh.Add(c)
+		}
+	}
+
+	// the blocks at gap.To were linked before their parents, add the refs of those edges
+	for _, c := range s.src.FindPointersByHeight(gap.To) {
+		n, err := s.src.Resolve(c)
+		if err != nil {
+			continue
+		}
+		for _, p := range n.Parents() {
+			if !fresh.Has(p) {
+				continue
+			}
+			if _, err := s.dag.Link(p, s.src); err != nil {
+				return xerrors.Errorf("link parent %s of %s: %w", p, c, err)
+			}
+		}
+	}
+
+	for _, ts := range chain {
+		if err := s.fetchTipSet(ctx, ts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadTipSet returns the tipset of tsk from the headers of the source window or still linked in
+// the dag, the cache may have evicted them
+func (s *Shutter) LoadTipSet(tsk types.TipSetKey) (*types.TipSet, error) {
+	return s.sourceTipSet(tsk.Cids())
+}
+
+// sourceTipSet builds a tipset from the headers recorded in the source, or linked in the dag
+// when the source dropped them
+func (s *Shutter) sourceTipSet(cids []cid.Cid) (*types.TipSet, error) {
+	blks := make([]*types.BlockHeader, 0, len(cids))
+	for _, c := range cids {
+		n, err := s.src.Resolve(c)
+		if err != nil {
+			if n, err = s.dag.Store().Get(c); err != nil {
+				return nil, xerrors.Errorf("resolve block %s: %w", c, err)
+			}
+		}
+		header := n.(*saaf.SnapNode).GetBlkHeader()
+		blks = append(blks, &header)
+	}
+
+	return types.NewTipSet(blks)
+}
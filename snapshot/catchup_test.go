@@ -0,0 +1,82 @@
+package snapshot
+
+import (
+	"context"
+	lapi "github.com/filecoin-project/lotus/api"
+	lstore "github.com/filecoin-project/lotus/chain/store"
+	"github.com/snapshot_snake/internal/testutil"
+	"testing"
+)
+
+// checkWindow checks the source has no gaps and the dag links the window as a single chain
+func checkWindow(t *testing.T, s *Shutter, retention int) {
+	t.Helper()
+
+	if gaps := s.src.Gaps(); len(gaps) != 0 {
+		t.Fatalf("gaps left: %v", gaps)
+	}
+	if nodes, refs := s.dag.Stats(); nodes != retention || refs != uint64(2*retention-1) {
+		t.Fatalf("dag holds %d nodes with %d refs, want %d with %d", nodes, refs, retention, 2*retention-1)
+	}
+}
+
+func TestCatchUpDroppedApply(t *testing.T) {
+	const retention = 20
+
+	s := newTestShutter(t, retention)
+	chain, objects := testutil.Chain(t, 25)
+	full := testutil.NewFullNode()
+	full.AddChain(chain, objects)
+	s.full = full
+
+	ctx := context.Background()
+	for i, ts := range chain {
+		if i == 15 {
+			// dropped by the head notifier
+			continue
+		}
+		s.headChange(ctx, &lapi.HeadChange{Type: lstore.HCApply, Val: ts})
+	}
+	drainGC(t, s)
+
+	checkWindow(t, s, retention)
+	if !s.linked(chain[15]) {
+		t.Fatal("dropped tipset is not linked")
+	}
+}
+
+func TestCatchUpForkWithoutRevert(t *testing.T) {
+	const retention = 20
+
+	s := newTestShutter(t, retention)
+	chain, objects := testutil.Chain(t, 25)
+	full := testutil.NewFullNode()
+	full.AddChain(chain, objects)
+	s.full = full
+
+	fork := testutil.Fork(t, chain[14])
+	full.AddObjects(objects[chain[14].Cids()[0]]...)
+
+	ctx := context.Background()
+	for _, ts := range chain[:14] {
+		s.headChange(ctx, &lapi.HeadChange{Type: lstore.HCApply, Val: ts})
+	}
+	s.headChange(ctx, &lapi.HeadChange{Type: lstore.HCApply, Val: fork})
+	if !s.linked(fork) {
+		t.Fatal("fork is not linked")
+	}
+
+	// the chain of the sibling is applied without reverting the fork
+	for _, ts := range chain[15:] {
+		s.headChange(ctx, &lapi.HeadChange{Type: lstore.HCApply, Val: ts})
+	}
+	drainGC(t, s)
+
+	checkWindow(t, s, retention)
+	if !s.linked(chain[14]) {
+		t.Fatal("sibling of the fork is not linked")
+	}
+	if refs := s.dag.GetRefs(fork.Cids()[0]); refs != 0 {
+		t.Fatalf("fork still holds %d refs", refs)
+	}
+}
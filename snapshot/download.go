@@ -0,0 +1,338 @@
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/snapshot_snake/snapshot/saaf"
+	"github.com/snapshot_snake/snapshot/store"
+	"golang.org/x/xerrors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DownloadPrefix is the path the snapshot download handler is served under
+const DownloadPrefix = "/snapshot/"
+
+// max number of on-the-fly exports kept on disk for range requests
+const downloadCacheSize = 2
+
+// NewDownloadHandler serves snapshots over http at /snapshot/latest.car and
+// /snapshot/<height>.car, with a .zst or .gz extension for compressed ones. Scheduled
+// snapshots are served when there are any, otherwise the snapshot is exported from the cache
+// into a temp file, kept for the following requests. The etag of an exported file is the hash
+// of its content, as the export of a tipset changes while the window moves, so range requests
+// only resume the same content. The recent-stateroots and format query parameters override the
+// schedule options.
+func NewDownloadHandler(s *Shutter) *DownloadHandler {
+	return &DownloadHandler{
+		s:       s,
+		files:   map[string]exportedFile{},
+		exports: map[string]*fileExport{},
+	}
+}
+
+type DownloadHandler struct {
+	s *Shutter
+
+	// mu guards the on-the-fly exports to temp files, files maps the keys of the requested
+	// exports to the finished ones and exports to the ones in progress, which requests with the
+	// same key wait for
+	mu      sync.Mutex
+	dir     string
+	files   map[string]exportedFile
+	order   []string
+	exports map[string]*fileExport
+}
+
+// exportedFile is an export in a temp file and the etag of its content
+type exportedFile struct {
+	path string
+	etag string
+}
+
+// fileExport is an export into a temp file in progress, file or err is set when done is closed
+type fileExport struct {
+	done chan struct{}
+	file exportedFile
+	err  error
+}
+
+func (h *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, DownloadPrefix)
+	target, compression, ok := parseDownloadName(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	opts := h.s.cfg.Schedule
+	opts.Compression = compression
+	query := r.URL.Query()
+	if v := query.Get("recent-stateroots"); v != "" {
+		rs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid recent-stateroots", http.StatusBadRequest)
+			return
+		}
+		if err := h.s.cfg.Retention.CheckRecentStateroots(rs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.RecentStateroots = rs
+	}
+	if v := query.Get("format"); v != "" {
+		if err := store.CheckFormat(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Format = v
+	}
+
+	// scheduled snapshots are only served with the schedule options
+	if !query.Has("recent-stateroots") && !query.Has("format") {
+		if snap, ok := h.scheduled(target, compression); ok {
+			h.serveFile(w, r, snap.Path, fmt.Sprintf("\"%d-%s%s\"", snap.Height, snap.Tipset, store.CompressionExt(compression)), compression)
+			return
+		}
+	}
+
+	ts, err := h.tipset(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	kc, err := ts.Key().Cid()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key := fmt.Sprintf("%d-%s-%d-%s%s", ts.Height(), kc, opts.RecentStateroots, opts.Format, store.CompressionExt(compression))
+
+	// head requests export too, the length is only known once exported
+	file, err := h.export(r.Context(), ts, key, opts)
+	if err != nil {
+		log.Errorf("http export at height %d err: %s", ts.Height(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.serveFile(w, r, file.path, file.etag, compression)
+}
+
+// Close removes the on-the-fly exports
+func (h *DownloadHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.dir == "" {
+		return nil
+	}
+	h.files = map[string]exportedFile{}
+	h.order = nil
+	return os.RemoveAll(h.dir)
+}
+
+// parseDownloadName splits latest.car or <height>.car with an optional compression extension
+// into the target, "latest" or the height, and the compression
+func parseDownloadName(name string) (string, string, bool) {
+	compression := store.CompressionNone
+	for _, c := range []string{store.CompressionZstd, store.CompressionGzip} {
+		if ext := store.CompressionExt(c); strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			compression = c
+			break
+		}
+	}
+
+	target := strings.TrimSuffix(name, ".car")
+	if target == name || target == "" {
+		return "", "", false
+	}
+	if target != "latest" {
+		if _, err := strconv.ParseInt(target, 10, 64); err != nil {
+			return "", "", false
+		}
+	}
+
+	return target, compression, true
+}
+
+// scheduled finds the scheduled snapshot of the target with the compression
+func (h *DownloadHandler) scheduled(target, compression string) (ScheduledSnapshot, bool) {
+	snaps, err := ListScheduled(h.s.cfg.Schedule.Dir)
+	if err != nil {
+		log.Warnf("list scheduled snapshots err: %s", err)
+		return ScheduledSnapshot{}, false
+	}
+
+	ext := ".car" + store.CompressionExt(compression)
+	for _, snap := range snaps {
+		if !strings.HasSuffix(snap.Path, ext) {
+			continue
+		}
+		if target == "latest" || target == strconv.FormatInt(int64(snap.Height), 10) {
+			return snap, true
+		}
+	}
+
+	return ScheduledSnapshot{}, false
+}
+
+// tipset resolves the target to a cached tipset, null rounds resolve to the previous tipset
+func (h *DownloadHandler) tipset(target string) (*types.TipSet, error) {
+	var cids []cid.Cid
+	if target == "latest" {
+		cids = h.s.src.Latest()
+	} else {
+		height, err := strconv.ParseInt(target, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if _, cids, err = h.s.src.LookbackPointers(saaf.Height(height)); err != nil {
+			return nil, err
+		}
+	}
+	if len(cids) == 0 {
+		return nil, xerrors.Errorf("no cached tipset")
+	}
+
+	return h.s.sourceTipSet(cids)
+}
+
+// export writes the snapshot into a temp file, reusing the file of a previous request with
+// the same key. Requests with the key of an export in progress wait for it, the export of a
+// canceled request is run again.
+func (h *DownloadHandler) export(ctx context.Context, ts *types.TipSet, key string, opts ScheduleOptions) (exportedFile, error) {
+	for {
+		h.mu.Lock()
+		if file, ok := h.files[key]; ok {
+			h.mu.Unlock()
+			return file, nil
+		}
+		e, running := h.exports[key]
+		if !running {
+			e = &fileExport{done: make(chan struct{})}
+			h.exports[key] = e
+		}
+		h.mu.Unlock()
+
+		if !running {
+			h.exportFile(ctx, e, ts, key, opts)
+			return e.file, e.err
+		}
+
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return exportedFile{}, ctx.Err()
+		}
+		if e.err == nil || !errors.Is(e.err, context.Canceled) {
+			return e.file, e.err
+		}
+	}
+}
+
+// exportFile runs the export e into a temp file, without holding the lock
+func (h *DownloadHandler) exportFile(ctx context.Context, e *fileExport, ts *types.TipSet, key string, opts ScheduleOptions) {
+	defer close(e.done)
+
+	file, err := h.exportTemp(ctx, ts, opts)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.exports, key)
+	e.file, e.err = file, err
+	if err != nil {
+		return
+	}
+
+	h.files[key] = file
+	h.order = append(h.order, key)
+	for len(h.order) > downloadCacheSize {
+		old := h.order[0]
+		h.order = h.order[1:]
+		_ = os.Remove(h.files[old].path)
+		delete(h.files, old)
+	}
+}
+
+// exportTemp writes the snapshot of ts into a new temp file, hashing its content for the etag
+func (h *DownloadHandler) exportTemp(ctx context.Context, ts *types.TipSet, opts ScheduleOptions) (exportedFile, error) {
+	h.mu.Lock()
+	if h.dir == "" {
+		dir, err := os.MkdirTemp("", "snapshot-http-*")
+		if err != nil {
+			h.mu.Unlock()
+			return exportedFile{}, xerrors.Errorf("create temp dir: %w", err)
+		}
+		h.dir = dir
+	}
+	dir := h.dir
+	h.mu.Unlock()
+
+	f, err := os.CreateTemp(dir, "export-*")
+	if err != nil {
+		return exportedFile{}, xerrors.Errorf("create temp file: %w", err)
+	}
+
+	sum := sha256.New()
+	err = h.s.runExport(ctx, JobSourceHTTP, ts, io.MultiWriter(f, sum), func(ctx context.Context, w io.Writer) error {
+		return store.ExportCompressed(ctx, h.s.cd, ts, w, opts.RecentStateroots, opts.Format, opts.Compression)
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return exportedFile{}, err
+	}
+
+	return exportedFile{
+		path: f.Name(),
+		etag: fmt.Sprintf("\"%x\"", sum.Sum(nil)),
+	}, nil
+}
+
+// serveFile serves the file with range and conditional request support
+func (h *DownloadHandler) serveFile(w http.ResponseWriter, r *http.Request, path, etag, compression string) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close() //nolint:errcheck
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setHeaders(w, etag, compression)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// setHeaders sets the content type and the etag of a snapshot response
+func setHeaders(w http.ResponseWriter, etag, compression string) {
+	if compression == store.CompressionNone {
+		w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("ETag", etag)
+}
@@ -0,0 +1,164 @@
+package snapshot
+
+import (
+	"bytes"
+	"github.com/ipld/go-car"
+	"github.com/snapshot_snake/internal/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func newTestDownload(t *testing.T) (*Shutter, *DownloadHandler) {
+	t.Helper()
+
+	s := newTestShutter(t, 20)
+	s.cfg.Schedule.Dir = t.TempDir()
+	chain, objects := testutil.Chain(t, 20)
+	for _, ts := range chain {
+		ingest(t, s, ts, objects)
+	}
+
+	h := NewDownloadHandler(s)
+	t.Cleanup(func() {
+		_ = h.Close()
+	})
+	return s, h
+}
+
+func TestDownloadHead(t *testing.T) {
+	s, h := newTestDownload(t)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, DownloadPrefix+"latest.car", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Header().Get("ETag") == "" || rec.Header().Get("Content-Length") == "" {
+		t.Fatalf("etag %q, length %q", rec.Header().Get("ETag"), rec.Header().Get("Content-Length"))
+	}
+
+	// the following get reuses the export
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, DownloadPrefix+"latest.car", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if jobs := s.Jobs().List(); len(jobs) != 1 {
+		t.Fatalf("head and get ran %d exports, want 1", len(jobs))
+	}
+}
+
+func TestDownloadGet(t *testing.T) {
+	s, h := newTestDownload(t)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, DownloadPrefix+"latest.car", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := rec.Header().Get("Content-Length"), strconv.Itoa(rec.Body.Len()); got != want {
+		t.Fatalf("length %q, want %q", got, want)
+	}
+	cr, err := car.NewCarReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := s.src.Latest()
+	if len(cr.Header.Roots) != len(latest) || cr.Header.Roots[0] != latest[0] {
+		t.Fatalf("roots %v, want %v", cr.Header.Roots, latest)
+	}
+}
+
+func TestDownloadWindowMoved(t *testing.T) {
+	s := newTestShutter(t, 20)
+	s.cfg.Schedule.Dir = t.TempDir()
+	chain, objects := testutil.Chain(t, 25)
+	for _, ts := range chain[:20] {
+		ingest(t, s, ts, objects)
+	}
+
+	h := NewDownloadHandler(s)
+	t.Cleanup(func() {
+		_ = h.Close()
+	})
+
+	get := func(name, ifRange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, DownloadPrefix+name, nil)
+		req.Header.Set("Range", "bytes=100-")
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get("20.car", "")
+	if first.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want %d", first.Code, http.StatusPartialContent)
+	}
+	etag := first.Header().Get("ETag")
+
+	// move the window and evict the export of height 20
+	for _, ts := range chain[20:] {
+		ingest(t, s, ts, objects)
+	}
+	drainGC(t, s)
+	get("21.car", "")
+	get("22.car", "")
+
+	// the export dropped the headers out of the window, the range must not resume it
+	rec := get("20.car", etag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want the full content", rec.Code)
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Fatal("etag unchanged while the content changed")
+	}
+}
+
+func TestDownloadRangeShared(t *testing.T) {
+	s, h := newTestDownload(t)
+
+	bodies := make([][]byte, 4)
+	var wg sync.WaitGroup
+	for i := range bodies {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, DownloadPrefix+"latest.car", nil)
+			req.Header.Set("Range", "bytes=0-99")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusPartialContent {
+				t.Errorf("status %d, want %d", rec.Code, http.StatusPartialContent)
+			}
+			bodies[i] = rec.Body.Bytes()
+		}()
+	}
+	wg.Wait()
+
+	for _, body := range bodies[1:] {
+		if !bytes.Equal(body, bodies[0]) {
+			t.Fatal("range requests got different content")
+		}
+	}
+	if jobs := s.Jobs().List(); len(jobs) != 1 {
+		t.Fatalf("range requests ran %d exports, want 1", len(jobs))
+	}
+
+	// the exported file answers head requests
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, DownloadPrefix+"latest.car", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") == "" {
+		t.Fatalf("head status %d, length %q", rec.Code, rec.Header().Get("Content-Length"))
+	}
+}
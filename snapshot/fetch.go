@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/snapshot_snake/snapshot/store"
+	typegen "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+	"sync"
+)
+
+// max number of concurrent ChainReadObj calls per fetched dag
+const fetchParallelism = 16
+
+// fetchTipSet fetches the objects of every block of the tipset
+func (s *Shutter) fetchTipSet(ctx context.Context, ts *types.TipSet) error {
+	for _, blk := range ts.Blocks() {
+		if err := s.fetchObjects(ctx, blk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchObjects pulls the message, receipt and state objects linked by the block header
+// from lotus and caches them under their own cids
+func (s *Shutter) fetchObjects(ctx context.Context, blk *types.BlockHeader) error {
+	roots := []cid.Cid{blk.Messages, blk.ParentMessageReceipts, blk.ParentStateRoot}
+	for _, root := range roots {
+		if err := s.fetchDAG(ctx, root); err != nil {
+			return xerrors.Errorf("fetch objects of block %s root %s: %w", blk.Cid(), root, err)
+		}
+	}
+
+	return nil
+}
+
+// fetchDAG walks the dag under root level by level and reads every object that is not
+// cached yet through ChainReadObj. The links of cached objects are walked too, the cache may
+// have evicted their children.
+func (s *Shutter) fetchDAG(ctx context.Context, root cid.Cid) error {
+	var mu sync.Mutex
+	seen := cid.NewSet()
+
+	level := []cid.Cid{root}
+	for len(level) > 0 {
+		var next []cid.Cid
+
+		eg, ectx := errgroup.WithContext(ctx)
+		eg.SetLimit(fetchParallelism)
+		for _, c := range level {
+			c := c
+			if !seen.Visit(c) || !store.Exportable(c) {
+				continue
+			}
+
+			eg.Go(func() error {
+				data, err := s.readObj(ectx, c)
+				if err != nil {
+					return err
+				}
+
+				if multicodec.Code(c.Prefix().Codec) != multicodec.DagCbor {
+					return nil
+				}
+
+				var links []cid.Cid
+				err = typegen.ScanForLinks(bytes.NewReader(data), func(l cid.Cid) {
+					links = append(links, l)
+				})
+				if err != nil {
+					return xerrors.Errorf("scanning for links of %s: %w", c, err)
+				}
+
+				mu.Lock()
+				next = append(next, links...)
+				mu.Unlock()
+
+				return nil
+			})
+		}
+
+		if err := eg.Wait(); err != nil {
+			return err
+		}
+
+		level = next
+	}
+
+	return nil
+}
+
+// readObj returns the data of the object c from the cache, or reads it through ChainReadObj
+// and caches it
+func (s *Shutter) readObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	if blk, err := s.cd.Get(ctx, c); err == nil {
+		return blk.RawData(), nil
+	}
+
+	data, err := s.full.ChainReadObj(ctx, c)
+	if err != nil {
+		return nil, xerrors.Errorf("read obj %s: %w", c, err)
+	}
+
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, xerrors.Errorf("build block %s: %w", c, err)
+	}
+
+	if err := s.cd.Put(ctx, c, blk); err != nil {
+		return nil, xerrors.Errorf("put block %s to cache: %w", c, err)
+	}
+	return data, nil
+}
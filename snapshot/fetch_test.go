@@ -0,0 +1,35 @@
+package snapshot
+
+import (
+	"context"
+	"github.com/snapshot_snake/internal/testutil"
+	"testing"
+)
+
+func TestFetchEvictedChildren(t *testing.T) {
+	ctx := context.Background()
+
+	s := newTestShutter(t, 20)
+	leaf := testutil.Node(t, 2)
+	child := testutil.Node(t, 1, leaf.Cid())
+	root := testutil.Node(t, 0, child.Cid())
+
+	full := testutil.NewFullNode()
+	full.AddObjects(root, child, leaf)
+	s.full = full
+
+	// the root is cached, its children were evicted
+	if err := s.cd.Put(ctx, root.Cid(), root); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.fetchDAG(ctx, root.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := s.cd.Has(ctx, child.Cid()); !has {
+		t.Fatal("child of the cached root is not fetched")
+	}
+	if has, _ := s.cd.Has(ctx, leaf.Cid()); !has {
+		t.Fatal("leaf of the cached root is not fetched")
+	}
+}
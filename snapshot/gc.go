@@ -0,0 +1,271 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/snapshot_snake/lib/metrics"
+	"github.com/snapshot_snake/snapshot/saaf"
+	typegen "github.com/whyrusleeping/cbor-gen"
+	"go.opencensus.io/stats"
+	"golang.org/x/xerrors"
+	"time"
+)
+
+// collect queues the pointers dropped from the source window for the gc loop
+func (s *Shutter) collect(rcids []cid.Cid) {
+	if len(rcids) == 0 {
+		return
+	}
+
+	s.gcMu.Lock()
+	s.gcPending = append(s.gcPending, rcids...)
+	s.gcMu.Unlock()
+
+	select {
+	case s.gcNotify <- struct{}{}:
+	default:
+	}
+}
+
+// runGC releases the pointers dropped from the source window as they are queued, after
+// sweeping the nodes left behind by previous runs
+func (s *Shutter) runGC(ctx context.Context) {
+	s.collect(s.orphans())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.gcNotify:
+		}
+
+		s.gcMu.Lock()
+		pending := s.gcPending
+		s.gcPending = nil
+		s.gcMu.Unlock()
+
+		if _, _, err := s.GC(ctx, pending); err != nil {
+			log.Warnf("gc err: %s", err)
+		}
+	}
+}
+
+// GC releases the pointers out of the source window from the dag, cascading to the parents
+// only they referenced, and deletes the headers of the released nodes from the cache. Once the
+// window moved SweepEpochs since the last sweep, the objects it left behind are swept too; the
+// first sweep also reclaims the ones of previous runs. It returns the number of reclaimed nodes
+// and deleted blocks, headers and objects.
+func (s *Shutter) GC(ctx context.Context, pointers []cid.Cid) (int, int, error) {
+	if len(pointers) == 0 {
+		return 0, 0, nil
+	}
+
+	begin := time.Now()
+	var nodes, blocks int
+	for _, p := range pointers {
+		// linked again since it was dropped
+		if _, err := s.src.Resolve(p); err == nil {
+			continue
+		}
+
+		removed, err := s.dag.Release(p)
+		nodes += len(removed)
+		if err != nil {
+			return nodes, blocks, err
+		}
+		if len(removed) == 0 {
+			// not linked, its header may still be cached
+			removed = []cid.Cid{p}
+		}
+
+		for _, r := range removed {
+			if has, _ := s.cd.Has(ctx, r); !has {
+				continue
+			}
+			if err := s.cd.DeleteBlock(ctx, r); err != nil {
+				return nodes, blocks, err
+			}
+			blocks++
+		}
+	}
+
+	stats.Record(ctx, metrics.GCNodes.M(int64(nodes)), metrics.GCBlocks.M(int64(blocks)))
+
+	var objects int
+	epochs := saaf.Height(s.cfg.Retention.SweepEpochs)
+	if oldest := s.src.OldestHeight(); epochs > 0 && (s.swept == 0 || oldest-s.swept >= epochs) {
+		var err error
+		objects, err = s.Sweep(ctx)
+		switch {
+		case errors.Is(err, errSweepBusy):
+			// retried by the next gc
+			log.Infow("sweep postponed", "reason", err)
+		case err != nil:
+			return nodes, blocks + objects, xerrors.Errorf("sweep: %w", err)
+		default:
+			s.swept = oldest
+		}
+	}
+
+	s.recordStats(ctx)
+	log.Infow("gc finished", "pointers", len(pointers), "nodes", nodes, "headers", blocks, "objects", objects, "elapsed", time.Since(begin).String())
+
+	return nodes, blocks + objects, nil
+}
+
+// errSweepBusy is returned by Sweep while backfills or imports write objects
+var errSweepBusy = xerrors.New("objects are being written")
+
+// Sweep deletes the cached blocks not reachable from the tipsets of the source window: the
+// messages, receipts and state objects of the tipsets the window dropped and the headers left
+// behind. The objects of the headers still linked in the dag or pinned by the views of running
+// exports are kept. It returns the number of deleted blocks, or errSweepBusy without waiting
+// while backfills or imports write objects.
+func (s *Shutter) Sweep(ctx context.Context) (int, error) {
+	if !s.objects.TryLock() {
+		return 0, errSweepBusy
+	}
+	defer s.objects.Unlock()
+
+	begin := time.Now()
+	marked := cid.NewSet()
+
+	// mark the window without holding the ingest lock, the objects of the tipsets linked by
+	// finished head changes are all fetched
+	s.ingest.Lock()
+	nodes := s.src.Nodes()
+	s.ingest.Unlock()
+
+	if err := s.markNodes(ctx, marked, nodes); err != nil {
+		return 0, err
+	}
+
+	// nothing is linked or unlinked until the blocks are deleted, views opened meanwhile only
+	// resolve the nodes of the dag
+	s.ingest.Lock()
+	defer s.ingest.Unlock()
+
+	// the tipsets linked since, the nodes out of the window not released yet and the ones
+	// exports still walk
+	if err := s.markNodes(ctx, marked, s.src.Nodes()); err != nil {
+		return 0, err
+	}
+	var linked []saaf.Node
+	for n := range s.dag.Store().All() {
+		linked = append(linked, n)
+	}
+	if err := s.markNodes(ctx, marked, linked); err != nil {
+		return 0, err
+	}
+	if err := s.markNodes(ctx, marked, s.dag.Pinned()); err != nil {
+		return 0, err
+	}
+
+	kctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	keys, err := s.cd.AllKeysChan(kctx)
+	if err != nil {
+		return 0, xerrors.Errorf("list cached blocks: %w", err)
+	}
+
+	var deleted int
+	for c := range keys {
+		if marked.Has(c) {
+			continue
+		}
+		// listed twice by the tiered store
+		if has, _ := s.cd.Has(ctx, c); !has {
+			continue
+		}
+		if err := s.cd.DeleteBlock(ctx, c); err != nil {
+			return deleted, xerrors.Errorf("delete %s: %w", c, err)
+		}
+		deleted++
+	}
+
+	stats.Record(ctx, metrics.GCObjects.M(int64(deleted)))
+	log.Infow("sweep finished", "tipsets", len(nodes), "marked", marked.Len(), "deleted", deleted, "elapsed", time.Since(begin).String())
+
+	return deleted, nil
+}
+
+// markNodes marks the nodes which are not marked yet
+func (s *Shutter) markNodes(ctx context.Context, marked *cid.Set, nodes []saaf.Node) error {
+	for _, n := range nodes {
+		if marked.Has(n.Pointer()) {
+			continue
+		}
+		if err := s.mark(ctx, marked, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mark adds the header of n and the cached objects it links to marked
+func (s *Shutter) mark(ctx context.Context, marked *cid.Set, n saaf.Node) error {
+	marked.Add(n.Pointer())
+
+	b := n.(*saaf.SnapNode).GetBlkHeader()
+	for _, root := range []cid.Cid{b.Messages, b.ParentMessageReceipts, b.ParentStateRoot} {
+		if err := s.markDAG(ctx, marked, root); err != nil {
+			return xerrors.Errorf("mark objects of block %s: %w", n.Pointer(), err)
+		}
+	}
+	return nil
+}
+
+// markDAG adds root and the cached objects under it to marked, objects already marked are
+// treated as marked sub dags
+func (s *Shutter) markDAG(ctx context.Context, marked *cid.Set, root cid.Cid) error {
+	toMark := []cid.Cid{root}
+	for len(toMark) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		c := toMark[len(toMark)-1]
+		toMark = toMark[:len(toMark)-1]
+		if !marked.Visit(c) || multicodec.Code(c.Prefix().Codec) != multicodec.DagCbor {
+			continue
+		}
+
+		blk, err := s.cd.Get(ctx, c)
+		if err != nil {
+			// not fetched
+			continue
+		}
+		err = typegen.ScanForLinks(bytes.NewReader(blk.RawData()), func(l cid.Cid) {
+			toMark = append(toMark, l)
+		})
+		if err != nil {
+			return xerrors.Errorf("scanning for links of %s: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// orphans lists the dag nodes out of the source window, left behind when the window moved
+// without the gc running
+func (s *Shutter) orphans() []cid.Cid {
+	var res []cid.Cid
+	for node := range s.dag.Store().All() {
+		p := node.Pointer()
+		if _, err := s.src.Resolve(p); err == nil {
+			continue
+		}
+		if s.dag.GetRefs(p) == 0 {
+			continue
+		}
+		res = append(res, p)
+	}
+
+	if len(res) > 0 {
+		log.Infow("found dag nodes out of the source window", "nodes", len(res))
+	}
+	return res
+}
@@ -0,0 +1,136 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/snapshot/saaf"
+	"net/http"
+	"time"
+)
+
+const (
+	HealthPath = "/healthz"
+	ReadyPath  = "/readyz"
+)
+
+// timeout of the lotus head request of a health check
+const healthLotusTimeout = 5 * time.Second
+
+// HealthReport is the state of the daemon served by the health endpoints
+type HealthReport struct {
+	// Healthy is set when lotus is reachable
+	Healthy bool
+	// Ready is set when the cache can serve a complete snapshot of the recent state roots window
+	Ready bool
+
+	Notifier   common.NotifierStatus
+	LotusError string `json:",omitempty"`
+
+	LotusHeight  abi.ChainEpoch
+	CachedHeight abi.ChainEpoch
+	OldestHeight abi.ChainEpoch
+	// HeadLag is the number of epochs the cache is behind the lotus head
+	HeadLag abi.ChainEpoch
+
+	RecentStateroots int64
+	// WindowCovered is set when every tipset of the window is cached, along with the state
+	// roots at both ends of it
+	WindowCovered bool
+	// Gaps are the heights whose parents are missing within the window
+	Gaps []abi.ChainEpoch `json:",omitempty"`
+}
+
+// Health checks lotus connectivity, the lag behind the lotus head and the window coverage
+func (s *Shutter) Health(ctx context.Context) *HealthReport {
+	opts := s.cfg.Health
+	report := &HealthReport{
+		Notifier:         s.sub.Status(),
+		RecentStateroots: opts.RecentStateroots,
+	}
+
+	hctx, cancel := context.WithTimeout(ctx, healthLotusTimeout)
+	defer cancel()
+	head, err := s.full.ChainHead(hctx)
+	if err != nil {
+		report.LotusError = err.Error()
+	} else {
+		report.LotusHeight = head.Height()
+	}
+	report.Healthy = err == nil && report.Notifier.Connected
+
+	latest := s.src.Latest()
+	if len(latest) == 0 {
+		return report
+	}
+
+	top, err := s.sourceTipSet(latest)
+	if err != nil {
+		return report
+	}
+	report.CachedHeight = top.Height()
+	report.OldestHeight = abi.ChainEpoch(s.src.OldestHeight())
+	if report.LotusHeight > 0 {
+		report.HeadLag = report.LotusHeight - report.CachedHeight
+	}
+
+	bottom := report.CachedHeight - abi.ChainEpoch(opts.RecentStateroots)
+	for _, gap := range s.src.Gaps() {
+		if abi.ChainEpoch(gap.To) > bottom {
+			report.Gaps = append(report.Gaps, abi.ChainEpoch(gap.To))
+		}
+	}
+
+	report.WindowCovered = report.OldestHeight <= bottom && len(report.Gaps) == 0 &&
+		s.hasStateRoot(ctx, latest) && s.hasStateRootAt(ctx, bottom)
+
+	report.Ready = report.Healthy && report.WindowCovered && int64(report.HeadLag) <= opts.MaxHeadLag
+
+	return report
+}
+
+// hasStateRootAt reports whether the parent state root of the tipset at height is cached
+func (s *Shutter) hasStateRootAt(ctx context.Context, height abi.ChainEpoch) bool {
+	_, cids, err := s.src.LookbackPointers(saaf.Height(height))
+	if err != nil {
+		return false
+	}
+	return s.hasStateRoot(ctx, cids)
+}
+
+// hasStateRoot reports whether the parent state root of the tipset is cached
+func (s *Shutter) hasStateRoot(ctx context.Context, cids []cid.Cid) bool {
+	// the header comes from the source, the cache may have evicted it
+	ts, err := s.sourceTipSet(cids)
+	if err != nil {
+		return false
+	}
+	has, _ := s.cd.Has(ctx, ts.ParentState())
+	return has
+}
+
+// NewHealthHandler serves the health report as json, with 503 when the daemon is not healthy
+// or, for the readiness handler, not ready
+func NewHealthHandler(s *Shutter, readiness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := s.Health(r.Context())
+
+		ok := report.Healthy
+		if readiness {
+			ok = report.Ready
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if ok {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Warnf("write health report err: %s", err)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package snapshot
+
+import (
+	"context"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/internal/testutil"
+	"testing"
+)
+
+// connectedNotifier is a head notifier reporting a live connection
+type connectedNotifier struct {
+	common.HeadNotifier
+}
+
+func (connectedNotifier) Status() common.NotifierStatus {
+	return common.NotifierStatus{Connected: true}
+}
+
+func TestHealthEvictedHeaders(t *testing.T) {
+	const retention = 20
+
+	s := newTestShutter(t, retention)
+	s.cfg.Health.RecentStateroots = retention - 1
+	s.sub = connectedNotifier{}
+	chain, objects := testutil.Chain(t, retention)
+	full := testutil.NewFullNode()
+	full.AddChain(chain, objects)
+	s.full = full
+	for _, ts := range chain {
+		ingest(t, s, ts, objects)
+	}
+
+	// the cache evicted the headers at both ends of the window
+	ctx := context.Background()
+	for _, ts := range []*types.TipSet{chain[0], chain[len(chain)-1]} {
+		if err := s.cd.DeleteBlock(ctx, ts.Cids()[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := s.Health(ctx)
+	if !report.Ready {
+		t.Fatalf("not ready: %+v", report)
+	}
+	if report.CachedHeight != chain[len(chain)-1].Height() {
+		t.Fatalf("cached height %d, want %d", report.CachedHeight, chain[len(chain)-1].Height())
+	}
+}
@@ -0,0 +1,217 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/snapshot_snake/snapshot/store"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImportResult summarizes a snapshot imported into the cache
+type ImportResult struct {
+	Roots []cid.Cid
+	// Blocks is the number of blocks put into the dag store
+	Blocks int
+	// Tipsets is the number of tipsets linked into the dag
+	Tipsets int
+	// Height and OldestHeight bound the linked tipsets
+	Height       abi.ChainEpoch
+	OldestHeight abi.ChainEpoch
+}
+
+// ImportFile imports the snapshot at path, which has to be in the import dir. Relative paths are
+// resolved against the import dir.
+func (s *Shutter) ImportFile(ctx context.Context, path string) (*ImportResult, error) {
+	path, err := s.importPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("open snapshot: %w", err)
+	}
+	defer fi.Close() //nolint:errcheck
+
+	return s.Import(ctx, fi)
+}
+
+// importPath resolves path in the import dir, following the symlinks so none leads out of it
+func (s *Shutter) importPath(path string) (string, error) {
+	dir, err := filepath.EvalSymlinks(s.cfg.Import.Dir)
+	if err != nil {
+		return "", xerrors.Errorf("resolve import dir: %w", err)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", xerrors.Errorf("resolve snapshot: %w", err)
+	}
+
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", xerrors.Errorf("snapshot %s is not in the import dir %s", path, s.cfg.Import.Dir)
+	}
+	return resolved, nil
+}
+
+// Import loads an (optionally compressed) CARv1 or CARv2 snapshot into the dag store and links
+// up to the retention window of its most recent tipsets, so exports can be served before new heads
+// arrive. Objects missing from the snapshot are not fetched from lotus.
+func (s *Shutter) Import(ctx context.Context, r io.Reader) (*ImportResult, error) {
+	dr, err := store.Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close() //nolint:errcheck
+
+	br, err := carv2.NewBlockReader(dr)
+	if err != nil {
+		return nil, xerrors.Errorf("read car header: %w", err)
+	}
+	if len(br.Roots) == 0 {
+		return nil, xerrors.Errorf("car has no roots")
+	}
+
+	res := &ImportResult{
+		Roots: br.Roots,
+	}
+
+	// the blocks are put before their tipsets are linked
+	s.objects.RLock()
+	defer s.objects.RUnlock()
+
+	// keep the headers of the chain from the roots back over the retention window as they are
+	// read, the memory cache may evict them before the chain is loaded
+	headers := map[cid.Cid]*types.BlockHeader{}
+	wanted := cid.NewSet()
+	for _, c := range br.Roots {
+		wanted.Add(c)
+	}
+	oldest := abi.ChainEpoch(-1)
+
+	for {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("read block %d: %w", res.Blocks, err)
+		}
+
+		if err := s.cd.Put(ctx, blk.Cid(), blk); err != nil {
+			return nil, xerrors.Errorf("put block %s: %w", blk.Cid(), err)
+		}
+
+		if wanted.Has(blk.Cid()) {
+			header, err := types.DecodeBlock(blk.RawData())
+			if err != nil {
+				return nil, xerrors.Errorf("decode block header %s: %w", blk.Cid(), err)
+			}
+			headers[blk.Cid()] = header
+
+			if oldest < 0 {
+				oldest = header.Height - abi.ChainEpoch(s.src.Retention())
+			}
+			if header.Height > oldest {
+				for _, c := range header.Parents {
+					wanted.Add(c)
+				}
+			}
+		}
+
+		res.Blocks++
+		if res.Blocks%100000 == 0 {
+			log.Infow("importing snapshot", "blocks", res.Blocks)
+		}
+	}
+
+	// collect the tipsets from the roots back to the oldest one in the snapshot
+	var chain []*types.TipSet
+	tsk := br.Roots
+	for len(chain) < s.src.Retention() {
+		ts, err := s.importTipSet(ctx, headers, tsk)
+		if err != nil {
+			if len(chain) == 0 {
+				return nil, xerrors.Errorf("load root tipset: %w", err)
+			}
+			log.Infow("snapshot chain ends", "height", chain[len(chain)-1].Height(), "reason", err)
+			break
+		}
+
+		chain = append(chain, ts)
+		if ts.Height() == 0 {
+			break
+		}
+		tsk = ts.Parents().Cids()
+	}
+
+	s.ingest.Lock()
+	defer s.ingest.Unlock()
+
+	linked, err := s.linkChain(ctx, chain)
+	if err != nil {
+		return nil, err
+	}
+	res.Tipsets = len(linked)
+
+	res.Height = chain[0].Height()
+	res.OldestHeight = chain[len(chain)-1].Height()
+	log.Infow("snapshot imported", "blocks", res.Blocks, "tipsets", res.Tipsets, "height", res.Height, "oldest", res.OldestHeight)
+
+	return res, nil
+}
+
+// importTipSet builds a tipset from the headers kept while reading a snapshot, headers read
+// before they were known to be part of the chain are loaded from the dag store
+func (s *Shutter) importTipSet(ctx context.Context, headers map[cid.Cid]*types.BlockHeader, cids []cid.Cid) (*types.TipSet, error) {
+	blks := make([]*types.BlockHeader, len(cids))
+	for i, c := range cids {
+		header, ok := headers[c]
+		if !ok {
+			return s.loadTipSet(ctx, cids)
+		}
+		blks[i] = header
+	}
+
+	return types.NewTipSet(blks)
+}
+
+// loadTipSet builds a tipset from headers in the dag store
+func (s *Shutter) loadTipSet(ctx context.Context, cids []cid.Cid) (*types.TipSet, error) {
+	blks := make([]*types.BlockHeader, len(cids))
+	for i, c := range cids {
+		b, err := s.cd.Get(ctx, c)
+		if err != nil {
+			return nil, xerrors.Errorf("get block %s: %w", c, err)
+		}
+
+		blk, err := types.DecodeBlock(b.RawData())
+		if err != nil {
+			return nil, xerrors.Errorf("decode block err: %s", err)
+		}
+		blks[i] = blk
+	}
+
+	return types.NewTipSet(blks)
+}
+
+// linked reports whether all blocks of the tipset are already linked in the dag
+func (s *Shutter) linked(ts *types.TipSet) bool {
+	for _, c := range ts.Cids() {
+		if s.dag.GetRefs(c) == 0 {
+			return false
+		}
+	}
+	return true
+}
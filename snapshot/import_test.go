@@ -0,0 +1,96 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/snapshot_snake/internal/testutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportEvictingCache(t *testing.T) {
+	const retention = 20
+
+	chain, objects := testutil.Chain(t, 30)
+	head := chain[len(chain)-1]
+
+	// write the chain head first, the way lotus exports it
+	var buf bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: head.Cids(), Version: 1}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		blk, err := chain[i].Blocks()[0].ToStorageBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := carutil.LdWrite(&buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range objects[blk.Cid()] {
+			if err := carutil.LdWrite(&buf, obj.Cid().Bytes(), obj.RawData()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// a cache holding a few blocks evicts the headers before the chain is loaded
+	s := newTestShutterCache(t, retention, 1024)
+
+	res, err := s.Import(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Tipsets != retention {
+		t.Fatalf("linked %d tipsets, want %d", res.Tipsets, retention)
+	}
+	if res.Height != head.Height() || res.OldestHeight != chain[len(chain)-retention].Height() {
+		t.Fatalf("linked heights %d to %d, want %d to %d", res.OldestHeight, res.Height, chain[len(chain)-retention].Height(), head.Height())
+	}
+	for _, ts := range chain[len(chain)-retention:] {
+		if !s.linked(ts) {
+			t.Fatalf("tipset at height %d not linked", ts.Height())
+		}
+	}
+	if got := types.NewTipSetKey(s.src.Latest()...); got != head.Key() {
+		t.Fatalf("latest tipset %s, want %s", got, head.Key())
+	}
+}
+
+func TestImportFileOutOfDir(t *testing.T) {
+	s := newTestShutter(t, 20)
+	s.cfg.Import.Dir = t.TempDir()
+
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(s.cfg.Import.Dir, "link.car")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	inside := filepath.Join(s.cfg.Import.Dir, "snapshot.car")
+	if err := os.WriteFile(inside, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{outside, "../" + filepath.Base(filepath.Dir(outside)) + "/secret", link, s.cfg.Import.Dir} {
+		if _, err := s.importPath(path); err == nil {
+			t.Fatalf("%s resolved out of the import dir", path)
+		}
+	}
+	for _, path := range []string{inside, "snapshot.car"} {
+		got, err := s.importPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(got) != "snapshot.car" {
+			t.Fatalf("%s resolved to %s", path, got)
+		}
+	}
+}
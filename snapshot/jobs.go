@@ -0,0 +1,280 @@
+package snapshot
+
+import (
+	"context"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	"github.com/snapshot_snake/snapshot/store"
+	"golang.org/x/xerrors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+const (
+	JobSourceRPC      = "rpc"
+	JobSourceHTTP     = "http"
+	JobSourceSchedule = "schedule"
+)
+
+// ExportJob is the status of an export
+type ExportJob struct {
+	ID string
+	// Kind is "full" or "diff"
+	Kind string
+	// Source is the rpc api, the http download handler or the export schedule
+	Source string
+	State  string
+	Error  string `json:",omitempty"`
+
+	// Height is the height of the exported tipset, the walk goes down from it to OldestHeight
+	Height       abi.ChainEpoch
+	OldestHeight abi.ChainEpoch
+	// CurrentHeight is the height of the last header walked
+	CurrentHeight abi.ChainEpoch
+	// Blocks is the number of objects walked and Bytes the number of bytes written
+	Blocks int64
+	Bytes  int64
+
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+}
+
+// Active reports whether the job is queued or running
+func (j ExportJob) Active() bool {
+	return j.State == JobQueued || j.State == JobRunning
+}
+
+// Job is an export registered in ExportJobs
+type Job struct {
+	m *ExportJobs
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	progress store.Progress
+
+	// info is guarded by the lock of the manager
+	info ExportJob
+}
+
+// ID returns the id of the job
+func (j *Job) ID() string {
+	return j.info.ID
+}
+
+// ExportJobs tracks the exports of the daemon, runs up to a limited number of them at once and
+// keeps the history of the finished ones
+type ExportJobs struct {
+	slots   chan struct{}
+	history int
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []string
+}
+
+func NewExportJobs(concurrency, history int) *ExportJobs {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &ExportJobs{
+		slots:   make(chan struct{}, concurrency),
+		history: history,
+		jobs:    map[string]*Job{},
+	}
+}
+
+// Add registers a queued job with the info of job, a random id is assigned when it has none.
+// The job is canceled with ctx.
+func (m *ExportJobs) Add(ctx context.Context, job ExportJob) (*Job, error) {
+	if job.ID == "" {
+		job.ID = uuid.New().String()
+	}
+	job.State = JobQueued
+	job.Created = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, ok := m.jobs[job.ID]; ok {
+		if old.info.Active() {
+			return nil, xerrors.Errorf("export job %s already exists", job.ID)
+		}
+		m.remove(job.ID)
+	}
+
+	jctx, cancel := context.WithCancel(ctx)
+	j := &Job{
+		m:      m,
+		cancel: cancel,
+		info:   job,
+	}
+	j.ctx = store.WithProgress(jctx, &j.progress)
+
+	m.jobs[job.ID] = j
+	m.order = append(m.order, job.ID)
+	m.prune()
+
+	return j, nil
+}
+
+// Run waits for a free slot and runs export with the context of the job, the bytes written to
+// w are counted in the progress of the job
+func (j *Job) Run(w io.Writer, export func(context.Context, io.Writer) error) error {
+	defer j.cancel()
+
+	select {
+	case j.m.slots <- struct{}{}:
+	case <-j.ctx.Done():
+		j.finish(j.ctx.Err())
+		return j.ctx.Err()
+	}
+	defer func() {
+		<-j.m.slots
+	}()
+
+	j.m.mu.Lock()
+	j.info.State = JobRunning
+	j.info.Started = time.Now()
+	j.m.mu.Unlock()
+
+	log.Infow("export job started", "id", j.info.ID, "kind", j.info.Kind, "source", j.info.Source, "height", j.info.Height)
+
+	err := export(j.ctx, j.progress.Writer(w))
+	j.finish(err)
+
+	return err
+}
+
+// finish records the outcome of the job
+func (j *Job) finish(err error) {
+	j.m.mu.Lock()
+	defer j.m.mu.Unlock()
+
+	j.info.Finished = time.Now()
+	switch {
+	case err == nil:
+		j.info.State = JobDone
+	case j.ctx.Err() != nil:
+		j.info.State = JobCanceled
+		j.info.Error = err.Error()
+	default:
+		j.info.State = JobFailed
+		j.info.Error = err.Error()
+	}
+
+	log.Infow("export job finished", "id", j.info.ID, "state", j.info.State, "blocks", j.progress.Blocks.Load(),
+		"bytes", j.progress.Bytes.Load(), "elapsed", j.info.Finished.Sub(j.info.Created).String())
+
+	j.m.prune()
+}
+
+// status returns the info of the job with its progress, the caller holds the lock
+func (j *Job) status() ExportJob {
+	info := j.info
+	info.Blocks = j.progress.Blocks.Load()
+	info.Bytes = j.progress.Bytes.Load()
+	if h := j.progress.Height.Load(); h > 0 {
+		info.CurrentHeight = abi.ChainEpoch(h)
+	}
+	return info
+}
+
+// List returns the active jobs and the recently finished ones, oldest first
+func (m *ExportJobs) List() []ExportJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]ExportJob, 0, len(m.order))
+	for _, id := range m.order {
+		res = append(res, m.jobs[id].status())
+	}
+
+	return res
+}
+
+// Get returns the job with id
+func (m *ExportJobs) Get(id string) (ExportJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return ExportJob{}, xerrors.Errorf("export job %s not found", id)
+	}
+	return j.status(), nil
+}
+
+// Cancel cancels the job with id, queued jobs leave the queue and running ones stop walking
+func (m *ExportJobs) Cancel(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return xerrors.Errorf("export job %s not found", id)
+	}
+	if !j.info.Active() {
+		return xerrors.Errorf("export job %s is %s", id, j.info.State)
+	}
+
+	log.Infow("canceling export job", "id", id)
+	j.cancel()
+	return nil
+}
+
+// prune drops the oldest finished jobs past the history, the caller holds the lock
+func (m *ExportJobs) prune() {
+	finished := 0
+	for _, id := range m.order {
+		if !m.jobs[id].info.Active() {
+			finished++
+		}
+	}
+
+	for i := 0; i < len(m.order) && finished > m.history; {
+		id := m.order[i]
+		if m.jobs[id].info.Active() {
+			i++
+			continue
+		}
+		m.remove(id)
+		finished--
+	}
+}
+
+// remove drops the job with id, the caller holds the lock
+func (m *ExportJobs) remove(id string) {
+	delete(m.jobs, id)
+	for i, oid := range m.order {
+		if oid == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// runExport runs a full export of ts as a job of the shutter
+func (s *Shutter) runExport(ctx context.Context, source string, ts *types.TipSet, w io.Writer, export func(context.Context, io.Writer) error) error {
+	job, err := s.jobs.Add(ctx, ExportJob{
+		Kind:         "full",
+		Source:       source,
+		Height:       ts.Height(),
+		OldestHeight: abi.ChainEpoch(s.src.OldestHeight()),
+	})
+	if err != nil {
+		return err
+	}
+	return job.Run(w, export)
+}
@@ -5,13 +5,16 @@ import (
 	"github.com/filecoin-project/lotus/chain/types"
 	block "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	logging "github.com/ipfs/go-log/v2"
+	"sort"
 	"sync"
 )
 
 var log = logging.Logger("saaf")
 
-const MAX_HEIGHT = 3000
+// DefaultRetention is the default number of heights kept in a SnapSource
+const DefaultRetention = 3000
 
 type SnapNode struct {
 	fCid cid.Cid
@@ -52,31 +55,154 @@ func NewSnapNode(id cid.Cid, header types.BlockHeader) *SnapNode {
 }
 
 type SnapSource struct {
+	// mu guards the mappings, ingestion writes them while rpc handlers and exports read them
+	mu sync.RWMutex
+
 	hpMapping map[Height][]cid.Cid
 
 	pnMapping map[cid.Cid]Node
+
+	// retention is the max number of heights kept, the oldest ones are dropped past it
+	retention int
+
+	// nodeDs and heightDs persist the mappings when the source is loaded from a datastore
+	nodeDs   datastore.Datastore
+	heightDs datastore.Datastore
 }
 
 func (s *SnapSource) HpRange() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	return len(s.hpMapping)
 }
 
 func (f *SnapSource) Latest() []cid.Cid {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
 	height := findLatestHeight(f.hpMapping)
-	log.Warnf("height %d", height)
-	return f.FindPointersByHeight(height)
+	log.Debugf("height %d", height)
+	return f.hpMapping[height]
 }
 
 func (f *SnapSource) Remove(pointer cid.Cid) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	delete(f.pnMapping, pointer)
+	if err := f.persistNode(pointer); err != nil {
+		log.Errorf("persist node %s: %s", pointer, err)
+	}
 }
 
 func (f *SnapSource) FindPointersByHeight(height Height) []cid.Cid {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
 	return f.hpMapping[height]
 }
 
+// LookbackPointers returns the pointers of the tipset at height, or of the closest
+// tipset before it when height is a null round
+func (f *SnapSource) LookbackPointers(height Height) (Height, []cid.Cid, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	latest := findLatestHeight(f.hpMapping)
+	if height > latest {
+		return 0, nil, fmt.Errorf("height %d is above the latest cached height %d", height, latest)
+	}
+
+	oldest := findOldestHeight(f.hpMapping)
+	for h := height; h >= oldest; h-- {
+		if cids, ok := f.hpMapping[h]; ok {
+			return h, cids, nil
+		}
+	}
+
+	return 0, nil, fmt.Errorf("height %d is below the oldest cached height %d", height, oldest)
+}
+
+// Nodes returns the nodes in the source
+func (f *SnapSource) Nodes() []Node {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	nodes := make([]Node, 0, len(f.pnMapping))
+	for _, node := range f.pnMapping {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// OldestHeight returns the oldest height in the source
+func (f *SnapSource) OldestHeight() Height {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return findOldestHeight(f.hpMapping)
+}
+
+// Gap is a hole in the source, the parents of the tipset at To are not the tipset at From
+type Gap struct {
+	From Height
+	To   Height
+	// Parents are the pointers of the missing parent tipset of the tipset at To
+	Parents []cid.Cid
+}
+
+// Gaps compares the parents of every tipset in the source with the tipset at the previous
+// height, null rounds are skipped as they have no entry
+func (f *SnapSource) Gaps() []Gap {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	heights := make([]Height, 0, len(f.hpMapping))
+	for height := range f.hpMapping {
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool {
+		return heights[i] < heights[j]
+	})
+
+	var gaps []Gap
+	for i := 1; i < len(heights); i++ {
+		from, to := heights[i-1], heights[i]
+
+		cids := f.hpMapping[to]
+		if len(cids) == 0 {
+			continue
+		}
+		node, ok := f.pnMapping[cids[0]]
+		if !ok {
+			continue
+		}
+
+		parents := node.Parents()
+		if types.NewTipSetKey(parents...) == types.NewTipSetKey(f.hpMapping[from]...) {
+			continue
+		}
+
+		gaps = append(gaps, Gap{
+			From:    from,
+			To:      to,
+			Parents: parents,
+		})
+	}
+
+	return gaps
+}
+
 func (f *SnapSource) GetBlockByCid(id cid.Cid) block.Block {
-	node := f.pnMapping[id]
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	node, ok := f.pnMapping[id]
+	if !ok {
+		log.Errorf("node %s not in source", id)
+		return nil
+	}
 	filNode := node.(*SnapNode)
 
 	blk, err := filNode.GetBlock()
@@ -111,26 +237,31 @@ func findLatestHeight(hpMapping map[Height][]cid.Cid) Height {
 }
 
 func (ffs *SnapSource) AddSource(ts types.TipSet) []cid.Cid {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+
 	height := ts.Height()
 	cids := ts.Cids()
 	blks := ts.Blocks()
 	var rcids []cid.Cid
-	var mu sync.Mutex
 
 	// add hpMapping
 	addNewHeight := func(height Height, cids []cid.Cid) {
-		mu.Lock()
-		defer mu.Unlock()
-
 		// add new ts to hpMapping
 		ffs.hpMapping[height] = cids
+		if err := ffs.persistHeight(height); err != nil {
+			log.Errorf("persist height %d: %s", height, err)
+		}
 
 		// check height
-		for len(ffs.hpMapping) > MAX_HEIGHT {
+		for len(ffs.hpMapping) > ffs.retention {
 			oldestHeight := findOldestHeight(ffs.hpMapping)
-			rcids = ffs.hpMapping[oldestHeight]
+			rcids = append(rcids, ffs.hpMapping[oldestHeight]...)
 			// delete ts in hpMapping
 			delete(ffs.hpMapping, oldestHeight)
+			if err := ffs.persistHeight(oldestHeight); err != nil {
+				log.Errorf("persist height %d: %s", oldestHeight, err)
+			}
 		}
 	}
 
@@ -143,17 +274,54 @@ func (ffs *SnapSource) AddSource(ts types.TipSet) []cid.Cid {
 		snapNode := NewSnapNode(id, *header)
 
 		ffs.pnMapping[id] = snapNode
+		if err := ffs.persistNode(id); err != nil {
+			log.Errorf("persist node %s: %s", id, err)
+		}
 	}
 
 	// delete ts in pnMapping
 	for _, rcid := range rcids {
 		delete(ffs.pnMapping, rcid)
+		if err := ffs.persistNode(rcid); err != nil {
+			log.Errorf("persist node %s: %s", rcid, err)
+		}
 	}
 
 	return rcids
 }
 
+// RemoveTipSet drops the nodes of a reverted tipset, and its height entry when the tipset is
+// still the one recorded at its height. It reports whether the height entry was removed.
+func (ffs *SnapSource) RemoveTipSet(ts types.TipSet) bool {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+
+	height := Height(ts.Height())
+
+	for _, id := range ts.Cids() {
+		delete(ffs.pnMapping, id)
+		if err := ffs.persistNode(id); err != nil {
+			log.Errorf("persist node %s: %s", id, err)
+		}
+	}
+
+	cids, ok := ffs.hpMapping[height]
+	if !ok || types.NewTipSetKey(cids...) != ts.Key() {
+		return false
+	}
+
+	delete(ffs.hpMapping, height)
+	if err := ffs.persistHeight(height); err != nil {
+		log.Errorf("persist height %d: %s", height, err)
+	}
+
+	return true
+}
+
 func (ffs *SnapSource) Resolve(p cid.Cid) (Node, error) {
+	ffs.mu.RLock()
+	defer ffs.mu.RUnlock()
+
 	node, ok := ffs.pnMapping[p]
 	if !ok {
 		return nil, fmt.Errorf("failed to resolve pointer to node %s", p)
@@ -161,12 +329,21 @@ func (ffs *SnapSource) Resolve(p cid.Cid) (Node, error) {
 	return node, nil
 }
 
-func NewSnapSource() *SnapSource {
+func NewSnapSource(retention int) *SnapSource {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
 	return &SnapSource{
 		hpMapping: map[Height][]cid.Cid{},
 		pnMapping: map[cid.Cid]Node{},
+		retention: retention,
 	}
 }
 
+// Retention returns the max number of heights kept
+func (ffs *SnapSource) Retention() int {
+	return ffs.retention
+}
+
 var _ Node = (*SnapNode)(nil)
 var _ Source = (*SnapSource)(nil)
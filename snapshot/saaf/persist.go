@@ -0,0 +1,291 @@
+package saaf
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"strconv"
+)
+
+var (
+	dagNodesPrefix  = datastore.NewKey("/dag/nodes")
+	dagRefsPrefix   = datastore.NewKey("/dag/refs")
+	srcNodesPrefix  = datastore.NewKey("/source/nodes")
+	srcHeightPrefix = datastore.NewKey("/source/heights")
+)
+
+func cidKey(p cid.Cid) datastore.Key {
+	return dshelp.NewKeyFromBinary(p.Bytes())
+}
+
+func keyCid(k string) (cid.Cid, error) {
+	b, err := dshelp.BinaryFromDsKey(datastore.NewKey(k))
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.Cast(b)
+}
+
+func encodeNode(n Node) ([]byte, error) {
+	snapNode, ok := n.(*SnapNode)
+	if !ok {
+		return nil, fmt.Errorf("can not persist node of type %T", n)
+	}
+	return snapNode.fBlk.Serialize()
+}
+
+func decodeNode(data []byte) (*SnapNode, error) {
+	header, err := types.DecodeBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewSnapNode(header.Cid(), *header), nil
+}
+
+// DsNodeStore is a durable node store keeping the serialized block headers in a datastore
+type DsNodeStore struct {
+	root datastore.Batching
+	ds   datastore.Datastore
+}
+
+func NewDsNodeStore(ds datastore.Batching) *DsNodeStore {
+	return &DsNodeStore{
+		root: ds,
+		ds:   namespace.Wrap(ds, dagNodesPrefix),
+	}
+}
+
+func (s *DsNodeStore) Put(p cid.Cid, n Node) error {
+	data, err := encodeNode(n)
+	if err != nil {
+		return err
+	}
+	return s.ds.Put(context.TODO(), cidKey(p), data)
+}
+
+func (s *DsNodeStore) Get(p cid.Cid) (Node, error) {
+	data, err := s.ds.Get(context.TODO(), cidKey(p))
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve pointer %s: %w", p, err)
+	}
+	return decodeNode(data)
+}
+
+// All sends the stored nodes and closes the channel
+func (s *DsNodeStore) All() <-chan Node {
+	ch := make(chan Node)
+	go func() {
+		defer close(ch)
+
+		res, err := s.ds.Query(context.TODO(), query.Query{})
+		if err != nil {
+			log.Errorf("query node store: %s", err)
+			return
+		}
+		defer res.Close()
+
+		for r := range res.Next() {
+			if r.Error != nil {
+				log.Errorf("iterate node store: %s", r.Error)
+				return
+			}
+			node, err := decodeNode(r.Value)
+			if err != nil {
+				log.Errorf("decode node %s: %s", r.Key, err)
+				continue
+			}
+			ch <- node
+		}
+	}()
+	return ch
+}
+
+func (s *DsNodeStore) Delete(p cid.Cid) error {
+	return s.ds.Delete(context.TODO(), cidKey(p))
+}
+
+// LoadDAG creates a DAG which persists its reference counts to ds and restores the
+// counts written by a previous run. When s is a DsNodeStore over ds, the node and ref writes
+// of each change are committed in one batch.
+func LoadDAG(s NodeStore, ds datastore.Batching) (*DAG, error) {
+	d := NewDAG(s)
+	d.ds = ds
+	if ns, ok := s.(*DsNodeStore); ok && ns.root == ds {
+		d.batchNodes = true
+	}
+
+	res, err := namespace.Wrap(ds, dagRefsPrefix).Query(context.TODO(), query.Query{})
+	if err != nil {
+		return nil, fmt.Errorf("query dag refs: %w", err)
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("iterate dag refs: %w", r.Error)
+		}
+		p, err := keyCid(r.Key)
+		if err != nil {
+			return nil, fmt.Errorf("decode dag ref key %s: %w", r.Key, err)
+		}
+		cnt, n := binary.Uvarint(r.Value)
+		if n <= 0 {
+			return nil, fmt.Errorf("decode dag ref count of %s", p)
+		}
+		d.refs[p] = cnt
+	}
+
+	log.Infof("loaded %d dag refs", len(d.refs))
+	return d, nil
+}
+
+// batch starts the batch of the writes of one change, nil when the refs are not persisted
+func (d *DAG) batch() (datastore.Batch, error) {
+	if d.ds == nil {
+		return nil, nil
+	}
+
+	b, err := d.ds.Batch(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start dag batch: %w", err)
+	}
+	return b, nil
+}
+
+// commit writes the batch b through to the datastore
+func (d *DAG) commit(b datastore.Batch) error {
+	if b == nil {
+		return nil
+	}
+
+	if err := b.Commit(context.TODO()); err != nil {
+		return fmt.Errorf("failed to commit dag batch: %w", err)
+	}
+	return nil
+}
+
+// persistRef writes the current reference count of p into b
+func (d *DAG) persistRef(b datastore.Batch, p cid.Cid) error {
+	if b == nil {
+		return nil
+	}
+
+	key := dagRefsPrefix.Child(cidKey(p))
+	cnt, ok := d.refs[p]
+	if !ok {
+		return b.Delete(context.TODO(), key)
+	}
+	return b.Put(context.TODO(), key, binary.AppendUvarint(nil, cnt))
+}
+
+// putNode stores n, into b when the node store is backed by the datastore of the refs
+func (d *DAG) putNode(b datastore.Batch, p cid.Cid, n Node) error {
+	if b == nil || !d.batchNodes {
+		return d.nodes.Put(p, n)
+	}
+
+	data, err := encodeNode(n)
+	if err != nil {
+		return err
+	}
+	return b.Put(context.TODO(), dagNodesPrefix.Child(cidKey(p)), data)
+}
+
+// deleteNode deletes the node of p, in b when the node store is backed by the datastore of
+// the refs
+func (d *DAG) deleteNode(b datastore.Batch, p cid.Cid) error {
+	if b == nil || !d.batchNodes {
+		return d.nodes.Delete(p)
+	}
+	return b.Delete(context.TODO(), dagNodesPrefix.Child(cidKey(p)))
+}
+
+// LoadSnapSource creates a SnapSource which persists its height and node mappings
+// to ds and restores the mappings written by a previous run. Heights beyond the retention are
+// dropped as new tipsets are added.
+func LoadSnapSource(ds datastore.Batching, retention int) (*SnapSource, error) {
+	src := NewSnapSource(retention)
+	src.nodeDs = namespace.Wrap(ds, srcNodesPrefix)
+	src.heightDs = namespace.Wrap(ds, srcHeightPrefix)
+
+	res, err := src.heightDs.Query(context.TODO(), query.Query{})
+	if err != nil {
+		return nil, fmt.Errorf("query source heights: %w", err)
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("iterate source heights: %w", r.Error)
+		}
+		height, err := strconv.ParseInt(datastore.NewKey(r.Key).Name(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("decode source height key %s: %w", r.Key, err)
+		}
+		tsk, err := types.TipSetKeyFromBytes(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("decode tipset key at height %d: %w", height, err)
+		}
+		src.hpMapping[Height(height)] = tsk.Cids()
+	}
+
+	nres, err := src.nodeDs.Query(context.TODO(), query.Query{})
+	if err != nil {
+		return nil, fmt.Errorf("query source nodes: %w", err)
+	}
+	defer nres.Close()
+
+	for r := range nres.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("iterate source nodes: %w", r.Error)
+		}
+		node, err := decodeNode(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("decode source node %s: %w", r.Key, err)
+		}
+		src.pnMapping[node.Pointer()] = node
+	}
+
+	log.Infof("loaded %d heights and %d nodes into snap source", len(src.hpMapping), len(src.pnMapping))
+	return src, nil
+}
+
+func heightKey(height Height) datastore.Key {
+	return datastore.NewKey(strconv.FormatInt(int64(height), 10))
+}
+
+func (ffs *SnapSource) persistHeight(height Height) error {
+	if ffs.heightDs == nil {
+		return nil
+	}
+
+	cids, ok := ffs.hpMapping[height]
+	if !ok {
+		return ffs.heightDs.Delete(context.TODO(), heightKey(height))
+	}
+	return ffs.heightDs.Put(context.TODO(), heightKey(height), types.NewTipSetKey(cids...).Bytes())
+}
+
+func (ffs *SnapSource) persistNode(p cid.Cid) error {
+	if ffs.nodeDs == nil {
+		return nil
+	}
+
+	node, ok := ffs.pnMapping[p]
+	if !ok {
+		return ffs.nodeDs.Delete(context.TODO(), cidKey(p))
+	}
+	data, err := encodeNode(node)
+	if err != nil {
+		return err
+	}
+	return ffs.nodeDs.Put(context.TODO(), cidKey(p), data)
+}
+
+var _ NodeStore = (*DsNodeStore)(nil)
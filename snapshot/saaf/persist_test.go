@@ -0,0 +1,154 @@
+package saaf
+
+import (
+	"context"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/snapshot_snake/internal/testutil"
+	"golang.org/x/xerrors"
+	"testing"
+)
+
+// loadPersisted loads the dag and the source persisted to ds
+func loadPersisted(t *testing.T, ds datastore.Batching, retention int) (*DAG, *SnapSource) {
+	t.Helper()
+
+	dag, err := LoadDAG(NewDsNodeStore(ds), ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := LoadSnapSource(ds, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dag, src
+}
+
+// storedNodes lists the pointers of the nodes in the store of dag
+func storedNodes(dag *DAG) *cid.Set {
+	set := cid.NewSet()
+	for n := range dag.Store().All() {
+		set.Add(n.Pointer())
+	}
+	return set
+}
+
+func TestPersistReload(t *testing.T) {
+	const retention = 10
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	dag, src := loadPersisted(t, ds, retention)
+	chain, _ := testutil.Chain(t, 25)
+	for _, ts := range chain[:20] {
+		for _, r := range linkTipSet(t, dag, src, ts) {
+			if _, err := dag.Release(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// a reverted tipset
+	src.RemoveTipSet(*chain[19])
+	for _, c := range chain[19].Cids() {
+		if err := dag.Unlink(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(dag *DAG, src *SnapSource) {
+		t.Helper()
+
+		rdag, rsrc := loadPersisted(t, ds, retention)
+		if got, want := len(rsrc.Nodes()), len(src.Nodes()); got != want {
+			t.Fatalf("reloaded source holds %d nodes, want %d", got, want)
+		}
+		rnodes, rrefs := rdag.Stats()
+		nodes, refs := dag.Stats()
+		if rnodes != nodes || rrefs != refs {
+			t.Fatalf("reloaded dag holds %d nodes with %d refs, want %d with %d", rnodes, rrefs, nodes, refs)
+		}
+		stored := storedNodes(rdag)
+		if stored.Len() != nodes {
+			t.Fatalf("reloaded node store holds %d nodes, want %d", stored.Len(), nodes)
+		}
+		for _, n := range src.Nodes() {
+			p := n.Pointer()
+			if !stored.Has(p) || rdag.GetRefs(p) != dag.GetRefs(p) {
+				t.Fatalf("node %s reloaded with %d refs, want %d", p, rdag.GetRefs(p), dag.GetRefs(p))
+			}
+		}
+	}
+	check(dag, src)
+
+	// the reloaded dag keeps persisting
+	dag, src = loadPersisted(t, ds, retention)
+	for _, ts := range chain[19:] {
+		for _, r := range linkTipSet(t, dag, src, ts) {
+			if _, err := dag.Release(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if nodes, refs := dag.Stats(); nodes != retention || refs != 2*retention-1 {
+		t.Fatalf("dag holds %d nodes with %d refs, want %d with %d", nodes, refs, retention, 2*retention-1)
+	}
+	check(dag, src)
+}
+
+// failingDs fails the commits of its batches while fail is set
+type failingDs struct {
+	datastore.Batching
+	fail bool
+}
+
+func (d *failingDs) Batch(ctx context.Context) (datastore.Batch, error) {
+	b, err := d.Batching.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &failingBatch{Batch: b, ds: d}, nil
+}
+
+type failingBatch struct {
+	datastore.Batch
+	ds *failingDs
+}
+
+func (b *failingBatch) Commit(ctx context.Context) error {
+	if b.ds.fail {
+		return xerrors.New("commit failed")
+	}
+	return b.Batch.Commit(ctx)
+}
+
+func TestPersistFailedBatch(t *testing.T) {
+	ds := &failingDs{Batching: dssync.MutexWrap(datastore.NewMapDatastore())}
+	dag, err := LoadDAG(NewDsNodeStore(ds), ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := NewSnapSource(10)
+	chain, _ := testutil.Chain(t, 5)
+	for _, ts := range chain[:4] {
+		linkTipSet(t, dag, src, ts)
+	}
+
+	// neither the node nor the refs of a failed link are written
+	ds.fail = true
+	src.AddSource(*chain[4])
+	if _, err := dag.Link(chain[4].Cids()[0], src); err == nil {
+		t.Fatal("link succeeded with a failed commit")
+	}
+	ds.fail = false
+
+	rdag, err := LoadDAG(NewDsNodeStore(ds), ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes, refs := rdag.Stats(); nodes != 4 || refs != 7 {
+		t.Fatalf("reloaded dag holds %d nodes with %d refs, want 4 with 7", nodes, refs)
+	}
+	if n := storedNodes(rdag).Len(); n != 4 {
+		t.Fatalf("reloaded node store holds %d nodes, want 4", n)
+	}
+}
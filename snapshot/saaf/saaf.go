@@ -3,8 +3,8 @@ package saaf
 import (
 	"fmt"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	"sync"
-	"time"
 )
 
 /*
@@ -44,79 +44,262 @@ type NodeStore interface {
 }
 
 type DAG struct {
+	// mu guards refs and serializes the node store updates of Link and Unlink
+	mu sync.RWMutex
 	// Invariant: alls nodes are tracked in both refs and nodes or neither
 	// refs tracks linked references to node at given pointer
 	refs map[cid.Cid]uint64
 	// nodes stores all nodes in the DAG
 	nodes NodeStore
+	// ds persists refs when the DAG is loaded from a datastore, along with the nodes when the
+	// node store is backed by the same datastore
+	ds         datastore.Batching
+	batchNodes bool
+	// views are the open views, Link and Unlink record their changes into them
+	views map[*View]struct{}
 }
 
 func NewDAG(s NodeStore) *DAG {
 	return &DAG{
 		refs:  make(map[cid.Cid]uint64),
 		nodes: s,
+		views: make(map[*View]struct{}),
 	}
 }
 
 func (d *DAG) GetRefs(pointer cid.Cid) uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	return d.refs[pointer]
 }
 
-func (d *DAG) Link(p cid.Cid, src Source) (cid.Cid, error) {
-	toLink := []cid.Cid{p}
+func (d *DAG) Link(root cid.Cid, src Source) (cid.Cid, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, err := d.batch()
+	if err != nil {
+		return root, err
+	}
+
+	toLink := []cid.Cid{root}
 	for len(toLink) > 0 {
 		p := toLink[0]
 		toLink = toLink[1:]
 		_, linked := d.refs[p]
 		if linked {
 			d.refs[p] += 1
+			if err := d.persistRef(b, p); err != nil {
+				return p, fmt.Errorf("failed to persist ref: %w", err)
+			}
 			continue
 		}
-		// if not linked then link node and traverse children
-		d.refs[p] = 1
 		n, err := src.Resolve(p)
 		if err != nil {
-			return p, err
+			if p == root {
+				return p, err
+			}
+			// parents outside the source are not tracked, they gain their refs when they are
+			// linked with their own tipset
+			continue
 		}
-		if err := d.nodes.Put(p, n); err != nil {
-			fmt.Errorf("failed to put to node store: %w", err)
+		// if not linked then link node and traverse children
+		d.refs[p] = 1
+		if err := d.persistRef(b, p); err != nil {
+			return p, fmt.Errorf("failed to persist ref: %w", err)
+		}
+		if err := d.putNode(b, p, n); err != nil {
+			return p, fmt.Errorf("failed to put to node store: %w", err)
+		}
+		for v := range d.views {
+			v.linked(p)
 		}
 		toLink = append(toLink, n.Parents()...)
 	}
+	if err := d.commit(b); err != nil {
+		return root, err
+	}
 	return cid.Cid{}, nil
 }
 
-func (d *DAG) Unlink(p cid.Cid) error {
-	toUnlink := []cid.Cid{p}
+func (d *DAG) Unlink(root cid.Cid) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.unlink(root)
+	return err
+}
+
+// Release drops root from the DAG whatever its reference count, along with the references its
+// children hold on it, and unlinks the parents it referenced. It returns the pointers of the
+// removed nodes, none when root is not linked.
+func (d *DAG) Release(root cid.Cid) ([]cid.Cid, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, linked := d.refs[root]; !linked {
+		return nil, nil
+	}
+	// leave a single reference, so unlink removes the node and cascades to its parents
+	d.refs[root] = 1
+	return d.unlink(root)
+}
+
+// unlink removes a reference to root and the nodes whose last reference it held, the caller
+// holds the lock
+func (d *DAG) unlink(root cid.Cid) ([]cid.Cid, error) {
+	b, err := d.batch()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []cid.Cid
+	toUnlink := []cid.Cid{root}
 	for len(toUnlink) > 0 {
 		p := toUnlink[0]
 		toUnlink = toUnlink[1:]
 		r, linked := d.refs[p]
 		if !linked {
-			return fmt.Errorf("failed to delete pointer %s, node not linked in DAG \n", p)
+			if p != root {
+				// untracked parents outside the source
+				continue
+			}
+			return removed, fmt.Errorf("failed to delete pointer %s, node not linked in DAG \n", p)
 		}
 		if r > 1 {
 			d.refs[p] -= 1
+			if err := d.persistRef(b, p); err != nil {
+				return removed, fmt.Errorf("failed to persist ref: %w", err)
+			}
 			continue
 		}
 		// if this is the last reference delete the sub DAG
 		delete(d.refs, p)
+		if err := d.persistRef(b, p); err != nil {
+			return removed, fmt.Errorf("failed to persist ref: %w", err)
+		}
 		n, err := d.nodes.Get(p)
 		if err != nil {
-			return fmt.Errorf("internal DAG error, pointer %s reference counted but failed to get node: %w", p, err)
+			return removed, fmt.Errorf("internal DAG error, pointer %s reference counted but failed to get node: %w", p, err)
 		}
 		toUnlink = append(toUnlink, n.Parents()...)
-		if err := d.nodes.Delete(p); err != nil {
-			return fmt.Errorf("internal DAG error, failed to delete node %s, %w", p, err)
+		for v := range d.views {
+			v.unlinked(p, n)
 		}
+		if err := d.deleteNode(b, p); err != nil {
+			return removed, fmt.Errorf("internal DAG error, failed to delete node %s, %w", p, err)
+		}
+		removed = append(removed, p)
 	}
-	return nil
+	if err := d.commit(b); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
+
+// Stats returns the number of linked nodes and the sum of their reference counts
+func (d *DAG) Stats() (int, uint64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var refs uint64
+	for _, r := range d.refs {
+		refs += r
+	}
+	return len(d.refs), refs
 }
 
 func (d *DAG) Store() NodeStore {
 	return d.nodes
 }
 
+// View is a copy-on-write view of the DAG, it resolves the nodes linked when it was taken. The
+// nodes unlinked afterwards are kept in the view and the ones linked afterwards are hidden, so
+// walks see a consistent DAG while nodes are linked and unlinked.
+type View struct {
+	d *DAG
+	// added and removed are guarded by the lock of the DAG
+	added   map[cid.Cid]struct{}
+	removed map[cid.Cid]Node
+}
+
+// View opens a view of the DAG, it must be closed when the walk is done
+func (d *DAG) View() *View {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v := &View{
+		d:       d,
+		added:   make(map[cid.Cid]struct{}),
+		removed: make(map[cid.Cid]Node),
+	}
+	d.views[v] = struct{}{}
+	return v
+}
+
+// Get resolves p as it was when the view was taken
+func (v *View) Get(p cid.Cid) (Node, error) {
+	v.d.mu.RLock()
+	defer v.d.mu.RUnlock()
+
+	if n, ok := v.removed[p]; ok {
+		return n, nil
+	}
+	if _, ok := v.added[p]; ok {
+		return nil, fmt.Errorf("could not resolve pointer %s, linked after the view", p)
+	}
+	if _, linked := v.d.refs[p]; !linked {
+		return nil, fmt.Errorf("could not resolve pointer %s", p)
+	}
+	return v.d.nodes.Get(p)
+}
+
+// Close releases the view, the DAG stops recording its changes into it
+func (v *View) Close() {
+	v.d.mu.Lock()
+	defer v.d.mu.Unlock()
+
+	delete(v.d.views, v)
+	v.added = nil
+	v.removed = nil
+}
+
+// Pinned returns the nodes unlinked since the open views were taken, walks over the views may
+// still resolve them
+func (d *DAG) Pinned() []Node {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var res []Node
+	for v := range d.views {
+		for _, n := range v.removed {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// linked records a node linked after the view was taken, the caller holds the lock of the DAG
+func (v *View) linked(p cid.Cid) {
+	if _, ok := v.removed[p]; ok {
+		// unlinked and linked again, the view keeps its copy
+		return
+	}
+	v.added[p] = struct{}{}
+}
+
+// unlinked keeps a copy of a node which was part of the view, the caller holds the lock of the
+// DAG
+func (v *View) unlinked(p cid.Cid, n Node) {
+	if _, ok := v.added[p]; ok {
+		return
+	}
+	if _, ok := v.removed[p]; !ok {
+		v.removed[p] = n
+	}
+}
+
 // In memory node store backed by a simple map
 type MapNodeStore struct {
 	nodes map[cid.Cid]Node
@@ -131,11 +314,17 @@ func NewMapNodeStore() MapNodeStore {
 
 func (s *MapNodeStore) Put(p cid.Cid, n Node) error {
 	log.Infof("put %s to dag", p.String())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.nodes[p] = n
 	return nil
 }
 
 func (s *MapNodeStore) Get(p cid.Cid) (Node, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	n, ok := s.nodes[p]
 	if !ok {
 		return nil, fmt.Errorf("could not resolve pointer %s", p)
@@ -143,27 +332,30 @@ func (s *MapNodeStore) Get(p cid.Cid) (Node, error) {
 	return n, nil
 }
 
+// All sends the stored nodes and closes the channel
 func (s *MapNodeStore) All() <-chan Node {
-	ch := make(chan Node, 0)
-	go func() {
-		ticker := time.NewTicker(time.Second * 30)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				s.mu.RLock()
-				for _, node := range s.nodes {
-					ch <- node
-				}
-				s.mu.RUnlock()
-			}
+	// send a copy, so a slow reader does not block Put and Delete
+	s.mu.RLock()
+	nodes := make([]Node, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	s.mu.RUnlock()
 
+	ch := make(chan Node)
+	go func() {
+		defer close(ch)
+		for _, node := range nodes {
+			ch <- node
 		}
 	}()
 	return ch
 }
 
 func (s *MapNodeStore) Delete(p cid.Cid) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if _, ok := s.nodes[p]; !ok {
 		return fmt.Errorf("%s not stored", p)
 	}
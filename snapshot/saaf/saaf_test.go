@@ -0,0 +1,163 @@
+package saaf
+
+import (
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/snapshot_snake/internal/testutil"
+	"sync"
+	"testing"
+)
+
+// linkTipSet adds ts to src and links its blocks the way the shutter does
+func linkTipSet(t testing.TB, dag *DAG, src *SnapSource, ts *types.TipSet) []cid.Cid {
+	rcids := src.AddSource(*ts)
+	for _, c := range ts.Cids() {
+		if _, err := dag.Link(c, src); err != nil {
+			t.Error(err)
+		}
+	}
+	return rcids
+}
+
+// walkView counts the nodes reachable from root in v
+func walkView(v *View, root cid.Cid) int {
+	var n int
+	for p := root; ; {
+		node, err := v.Get(p)
+		if err != nil {
+			return n
+		}
+		n++
+
+		parents := node.Parents()
+		if len(parents) == 0 {
+			return n
+		}
+		p = parents[0]
+	}
+}
+
+func TestDAGConcurrentIngest(t *testing.T) {
+	const retention = 10
+
+	store := NewMapNodeStore()
+	dag := NewDAG(&store)
+	src := NewSnapSource(retention)
+	chain, _ := testutil.Chain(t, 200)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for i, ts := range chain {
+			for _, r := range linkTipSet(t, dag, src, ts) {
+				if _, err := dag.Release(r); err != nil {
+					t.Error(err)
+				}
+			}
+
+			// revert and apply again every few tipsets
+			if i%7 == 6 {
+				src.RemoveTipSet(*ts)
+				for _, c := range ts.Cids() {
+					if err := dag.Unlink(c); err != nil {
+						t.Error(err)
+					}
+				}
+				linkTipSet(t, dag, src, ts)
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				latest := src.Latest()
+				src.HpRange()
+				src.Gaps()
+				dag.Stats()
+				if len(latest) == 0 {
+					continue
+				}
+				if _, err := src.Resolve(latest[0]); err != nil {
+					continue
+				}
+
+				v := dag.View()
+				if n := walkView(v, latest[0]); n > retention+1 {
+					t.Errorf("walked %d nodes, retention is %d", n, retention)
+				}
+				v.Close()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if got := src.HpRange(); got != retention {
+		t.Fatalf("source holds %d heights, want %d", got, retention)
+	}
+	if nodes, _ := dag.Stats(); nodes != retention {
+		t.Fatalf("dag holds %d nodes, want %d", nodes, retention)
+	}
+}
+
+func TestViewConsistentWhileUnlinking(t *testing.T) {
+	store := NewMapNodeStore()
+	dag := NewDAG(&store)
+	src := NewSnapSource(20)
+	chain, _ := testutil.Chain(t, 40)
+
+	for _, ts := range chain[:20] {
+		linkTipSet(t, dag, src, ts)
+	}
+	head := chain[19].Cids()[0]
+
+	v := dag.View()
+	defer v.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		// move the window past the viewed tipsets
+		for _, ts := range chain[20:] {
+			for _, r := range linkTipSet(t, dag, src, ts) {
+				if _, err := dag.Release(r); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if n := walkView(v, head); n != 20 {
+			t.Fatalf("walked %d nodes from the viewed head, want 20", n)
+		}
+	}
+	wg.Wait()
+
+	if n := walkView(v, head); n != 20 {
+		t.Fatalf("walked %d nodes from the viewed head, want 20", n)
+	}
+	if _, err := v.Get(chain[39].Cids()[0]); err == nil {
+		t.Fatal("node linked after the view is visible in it")
+	}
+	if _, err := dag.Store().Get(head); err == nil {
+		t.Fatal("viewed head is still in the node store")
+	}
+}
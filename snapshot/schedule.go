@@ -0,0 +1,217 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/snapshot_snake/snapshot/store"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const scheduledPrefix = "snapshot_"
+
+// ScheduledSnapshot is a snapshot file written by the export schedule
+type ScheduledSnapshot struct {
+	Height abi.ChainEpoch
+	// Tipset is the cid of the tipset key of the snapshot root
+	Tipset  string
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ScheduledFileName names the snapshot of ts as snapshot_<height>_<tipset key cid>.car with
+// the extension of the compression
+func ScheduledFileName(ts *types.TipSet, compression string) (string, error) {
+	kc, err := ts.Key().Cid()
+	if err != nil {
+		return "", xerrors.Errorf("tipset key cid: %w", err)
+	}
+
+	return fmt.Sprintf("%s%d_%s.car%s", scheduledPrefix, ts.Height(), kc, store.CompressionExt(compression)), nil
+}
+
+// ListScheduled lists the scheduled snapshots in dir, latest first
+func ListScheduled(dir string) ([]ScheduledSnapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("read snapshot dir: %w", err)
+	}
+
+	var res []ScheduledSnapshot
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, scheduledPrefix) || !strings.Contains(name, ".car") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(name, scheduledPrefix), "_", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		height, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		res = append(res, ScheduledSnapshot{
+			Height:  abi.ChainEpoch(height),
+			Tipset:  parts[1][:strings.Index(parts[1], ".car")],
+			Path:    filepath.Join(dir, name),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Height > res[j].Height
+	})
+
+	return res, nil
+}
+
+// notifyApplied hands an applied tipset to the export schedule, replacing a pending one
+func (s *Shutter) notifyApplied(ts *types.TipSet) {
+	if !s.cfg.Schedule.Enabled() {
+		return
+	}
+
+	select {
+	case <-s.applied:
+	default:
+	}
+	s.applied <- ts
+}
+
+// runSchedule exports the head each time it crosses a multiple of EveryEpochs and every Interval
+func (s *Shutter) runSchedule(ctx context.Context) {
+	opts := s.cfg.Schedule
+	if err := store.CheckFormat(opts.Format); err != nil {
+		log.Errorf("export schedule disabled: %s", err)
+		return
+	}
+	if err := store.CheckCompression(opts.Compression); err != nil {
+		log.Errorf("export schedule disabled: %s", err)
+		return
+	}
+
+	log.Infow("export schedule started", "dir", opts.Dir, "every_epochs", opts.EveryEpochs, "interval", time.Duration(opts.Interval))
+
+	var tick <-chan time.Time
+	if opts.Interval > 0 {
+		ticker := time.NewTicker(time.Duration(opts.Interval))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var head *types.TipSet
+	var last abi.ChainEpoch = -1
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ts := <-s.applied:
+			prev := head
+			head = ts
+			if opts.EveryEpochs <= 0 || prev == nil {
+				continue
+			}
+
+			every := abi.ChainEpoch(opts.EveryEpochs)
+			if ts.Height()/every == prev.Height()/every || ts.Height() == last {
+				continue
+			}
+		case <-tick:
+			if head == nil || head.Height() == last {
+				continue
+			}
+		}
+
+		if err := s.scheduledExport(ctx, head); err != nil {
+			log.Errorf("scheduled export at height %d err: %s", head.Height(), err)
+			continue
+		}
+		last = head.Height()
+	}
+}
+
+// scheduledExport writes the snapshot of ts into the schedule dir and prunes the old ones
+func (s *Shutter) scheduledExport(ctx context.Context, ts *types.TipSet) error {
+	opts := s.cfg.Schedule
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return xerrors.Errorf("create snapshot dir: %w", err)
+	}
+
+	name, err := ScheduledFileName(ts, opts.Compression)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(opts.Dir, name)
+
+	begin := time.Now()
+	log.Infow("scheduled export started", "height", ts.Height(), "path", path)
+
+	// write to a temp file first, so only complete snapshots carry the snapshot name
+	tmp, err := os.CreateTemp(opts.Dir, ".export-*")
+	if err != nil {
+		return xerrors.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	err = s.runExport(ctx, JobSourceSchedule, ts, tmp, func(ctx context.Context, w io.Writer) error {
+		return store.ExportCompressed(ctx, s.cd, ts, w, opts.RecentStateroots, opts.Format, opts.Compression)
+	})
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return xerrors.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return xerrors.Errorf("rename snapshot: %w", err)
+	}
+
+	log.Infow("scheduled export finished", "height", ts.Height(), "path", path, "elapsed", time.Since(begin).String())
+
+	return s.pruneScheduled()
+}
+
+// pruneScheduled removes the scheduled snapshots beyond Keep, oldest first
+func (s *Shutter) pruneScheduled() error {
+	keep := s.cfg.Schedule.Keep
+	if keep <= 0 {
+		return nil
+	}
+
+	snaps, err := ListScheduled(s.cfg.Schedule.Dir)
+	if err != nil {
+		return err
+	}
+
+	for i := keep; i < len(snaps); i++ {
+		log.Infow("removing old scheduled snapshot", "height", snaps[i].Height, "path", snaps[i].Path)
+		if err := os.Remove(snaps[i].Path); err != nil {
+			return xerrors.Errorf("remove old snapshot: %w", err)
+		}
+	}
+
+	return nil
+}
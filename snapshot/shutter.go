@@ -2,43 +2,136 @@ package snapshot
 
 import (
 	"context"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v0api"
+	"github.com/filecoin-project/lotus/chain/store"
 	"github.com/filecoin-project/lotus/chain/types"
 	lconfig "github.com/filecoin-project/lotus/node/config"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/lib/metrics"
 	"github.com/snapshot_snake/snapshot/saaf"
+	snapstore "github.com/snapshot_snake/snapshot/store"
+	"go.opencensus.io/stats"
+	"golang.org/x/xerrors"
+	"sync"
 	"time"
 )
 
 const DefaultHTTPListenAddr = ":15002"
 const DefaultRPCListenAddr = "/ip4/127.0.0.1/tcp/6789"
 
+const (
+	NotifyModeChan = "chan"
+	NotifyModePoll = "poll"
+)
+
+const (
+	StoreBackendMemory  = "memory"
+	StoreBackendLevelDB = "leveldb"
+	StoreBackendTiered  = "tiered"
+)
+
 var log = logging.Logger("snapshot")
 
 func DefaultConfig() Config {
 	return Config{
-		LotusAPI: DefaultLotusAPIOptions(),
-		HTTP:     DefaultHTTPOptions(),
+		LotusAPI:  DefaultLotusAPIOptions(),
+		HTTP:      DefaultHTTPOptions(),
+		Store:     DefaultStoreOptions(),
+		Retention: DefaultRetentionOptions(),
+		Backfill:  DefaultBackfillOptions(),
+		Schedule:  DefaultScheduleOptions(),
+		Import:    DefaultImportOptions(),
+		Health:    DefaultHealthOptions(),
+		Jobs:      DefaultJobsOptions(),
 	}
 }
 
 type Config struct {
-	LotusAPI LotusAPI
-	HTTP     HTTPOptions
+	LotusAPI  LotusAPI
+	HTTP      HTTPOptions
+	Store     StoreOptions
+	Retention RetentionOptions
+	Backfill  BackfillOptions
+	Schedule  ScheduleOptions
+	Import    ImportOptions
+	Health    HealthOptions
+	Jobs      JobsOptions
+}
+
+// Validate checks the retention window covers the recent stateroots windows served and the
+// cache sizing, so a daemon does not start with a window it can not export
+func (c Config) Validate() error {
+	ret := c.Retention
+	if ret.Epochs <= 0 {
+		return xerrors.Errorf("retention epochs must be positive, got %d", ret.Epochs)
+	}
+	if ret.SweepEpochs < 0 {
+		return xerrors.Errorf("sweep epochs must not be negative, got %d", ret.SweepEpochs)
+	}
+	if ret.MaxRecentStateroots <= 0 {
+		return xerrors.Errorf("max recent stateroots must be positive, got %d", ret.MaxRecentStateroots)
+	}
+	// exports walk the headers back over the recent stateroots window
+	if ret.MaxRecentStateroots > ret.Epochs {
+		return xerrors.Errorf("max recent stateroots %d over the %d retained epochs", ret.MaxRecentStateroots, ret.Epochs)
+	}
+	if err := ret.CheckRecentStateroots(c.Schedule.RecentStateroots); err != nil {
+		return xerrors.Errorf("schedule: %w", err)
+	}
+	if err := ret.CheckRecentStateroots(c.Health.RecentStateroots); err != nil {
+		return xerrors.Errorf("health: %w", err)
+	}
+	if c.Backfill.Epochs > ret.Epochs {
+		return xerrors.Errorf("backfill epochs %d over the %d retained epochs", c.Backfill.Epochs, ret.Epochs)
+	}
+	if c.Store.Backend != StoreBackendLevelDB && c.Store.CacheSize <= 0 {
+		return xerrors.Errorf("cache size must be positive, got %d", c.Store.CacheSize)
+	}
+	if c.Jobs.MaxConcurrent <= 0 {
+		return xerrors.Errorf("max concurrent export jobs must be positive, got %d", c.Jobs.MaxConcurrent)
+	}
+	if c.Store.Backend == StoreBackendTiered && c.Store.SpillPath == "" {
+		return xerrors.Errorf("tiered store without a spill path")
+	}
+
+	return nil
 }
 
 type LotusAPI struct {
 	APIAddr  string
 	APIToken string
+	// Endpoints are more lotus nodes to fail over to, along with APIAddr
+	Endpoints []LotusEndpoint
+	// HealthCheckInterval is the interval of the endpoint health checks, an endpoint more than
+	// MaxHeadLag epochs behind the heaviest head is failed over
+	HealthCheckInterval lconfig.Duration
+	MaxHeadLag          int64
+	// NotifyMode selects how head changes are received, "chan" subscribes to ChainNotify and
+	// "poll" polls ChainHead every PollInterval for gateways without websocket support
+	NotifyMode   string
+	PollInterval lconfig.Duration
 }
 
 func DefaultLotusAPIOptions() LotusAPI {
 	return LotusAPI{
-		APIAddr:  "/ip4/127.0.0.1/tcp/1234",
-		APIToken: "",
+		APIAddr:      "/ip4/127.0.0.1/tcp/1234",
+		APIToken:     "",
+		NotifyMode:   NotifyModeChan,
+		PollInterval: lconfig.Duration(10 * time.Second),
+
+		HealthCheckInterval: lconfig.Duration(10 * time.Second),
+		MaxHeadLag:          3,
 	}
 }
 
+type LotusEndpoint struct {
+	APIAddr  string
+	APIToken string
+}
+
 type HTTPOptions struct {
 	RPCListen  string
 	Listen     string
@@ -53,61 +146,290 @@ func DefaultHTTPOptions() HTTPOptions {
 	}
 }
 
-func New(ctx context.Context, sub common.HeadNotifier, cs common.DagStore, dag *saaf.DAG, src *saaf.SnapSource) *Shutter {
+type StoreOptions struct {
+	// Backend of the dag store, "memory", "leveldb" or "tiered" for a memory cache spilling its
+	// evictions to disk
+	Backend string
+	// Path of the on-disk store, relative paths are resolved against the repo path
+	Path string
+	// CacheSize bounds the block data held by the memory backend in bytes
+	CacheSize int64
+	// SpillPath is the disk tier of the tiered backend, cleared on startup
+	SpillPath string
+}
+
+func DefaultStoreOptions() StoreOptions {
+	return StoreOptions{
+		Backend:   StoreBackendMemory,
+		Path:      "blockstore",
+		CacheSize: snapstore.DefaultCacheSize,
+		SpillPath: "spill",
+	}
+}
+
+type RetentionOptions struct {
+	// Epochs is the number of heights kept in the cache, older tipsets are garbage collected
+	Epochs int64
+	// MaxRecentStateroots is the largest recent stateroots window served by exports, it has
+	// to fit in the retained epochs
+	MaxRecentStateroots int64
+	// SweepEpochs is the number of epochs the window moves between sweeps of the messages,
+	// receipts and state objects it left behind, 0 disables the sweeps
+	SweepEpochs int64
+}
+
+func DefaultRetentionOptions() RetentionOptions {
+	return RetentionOptions{
+		Epochs:              saaf.DefaultRetention,
+		MaxRecentStateroots: 2000,
+		SweepEpochs:         120,
+	}
+}
+
+// CheckRecentStateroots rejects a recent stateroots window larger than the one served
+func (o RetentionOptions) CheckRecentStateroots(rs int64) error {
+	if rs < 0 {
+		return xerrors.Errorf("negative recent stateroots %d", rs)
+	}
+	if rs > o.MaxRecentStateroots {
+		return xerrors.Errorf("recent stateroots %d over the max of %d", rs, o.MaxRecentStateroots)
+	}
+	return nil
+}
+
+type BackfillOptions struct {
+	// Epochs to backfill from the lotus head on startup, 0 disables the backfill
+	Epochs int64
+	// Parallelism bounds the number of tipsets whose objects are fetched concurrently
+	Parallelism int
+}
+
+func DefaultBackfillOptions() BackfillOptions {
+	return BackfillOptions{
+		Epochs:      0,
+		Parallelism: 4,
+	}
+}
+
+type ScheduleOptions struct {
+	// Dir receives the scheduled snapshots, relative paths are resolved against the repo path
+	Dir string
+	// EveryEpochs exports the head each time it crosses a multiple of EveryEpochs, 0 disables it
+	EveryEpochs int64
+	// Interval exports the head on a fixed interval, 0 disables it
+	Interval lconfig.Duration
+	// Keep is the number of scheduled snapshots kept in Dir, 0 keeps all of them
+	Keep int
+
+	RecentStateroots int64
+	Format           string
+	Compression      string
+}
+
+func DefaultScheduleOptions() ScheduleOptions {
+	return ScheduleOptions{
+		Dir:              "snapshots",
+		EveryEpochs:      0,
+		Interval:         0,
+		Keep:             3,
+		RecentStateroots: 900,
+		Format:           snapstore.FormatCarV1,
+		Compression:      snapstore.CompressionNone,
+	}
+}
+
+// Enabled reports whether any schedule is set
+func (o ScheduleOptions) Enabled() bool {
+	return o.EveryEpochs > 0 || o.Interval > 0
+}
+
+type ImportOptions struct {
+	// Dir holds the snapshots imported over rpc, relative paths are resolved against the repo
+	// path and files out of it are rejected
+	Dir string
+}
+
+func DefaultImportOptions() ImportOptions {
+	return ImportOptions{
+		Dir: "imports",
+	}
+}
+
+type HealthOptions struct {
+	// RecentStateroots is the window the cache has to cover to be ready
+	RecentStateroots int64
+	// MaxHeadLag is the max number of epochs the cache may be behind the lotus head to be ready
+	MaxHeadLag int64
+}
+
+func DefaultHealthOptions() HealthOptions {
+	return HealthOptions{
+		RecentStateroots: 900,
+		MaxHeadLag:       5,
+	}
+}
+
+type JobsOptions struct {
+	// MaxConcurrent is the number of exports run at once, the others wait in a queue
+	MaxConcurrent int
+	// History is the number of finished export jobs kept for listing
+	History int
+}
+
+func DefaultJobsOptions() JobsOptions {
+	return JobsOptions{
+		MaxConcurrent: 2,
+		History:       20,
+	}
+}
+
+func New(ctx context.Context, cfg Config, full v0api.FullNode, sub common.HeadNotifier, cs common.DagStore, dag *saaf.DAG, src *saaf.SnapSource) *Shutter {
 	shutter := &Shutter{
-		sub: sub,
-		cd:  cs,
-		dag: dag,
-		src: src,
+		cfg:  cfg,
+		full: full,
+		sub:  sub,
+		cd:   cs,
+		dag:  dag,
+		src:  src,
+
+		jobs:     NewExportJobs(cfg.Jobs.MaxConcurrent, cfg.Jobs.History),
+		applied:  make(chan *types.TipSet, 1),
+		gcNotify: make(chan struct{}, 1),
 	}
 	return shutter
 }
 
 type Shutter struct {
-	sub common.HeadNotifier
-	cd  common.DagStore
+	cfg  Config
+	full v0api.FullNode
+	sub  common.HeadNotifier
+	cd   common.DagStore
 
 	dag *saaf.DAG
 	src *saaf.SnapSource
+
+	jobs *ExportJobs
+
+	// applied feeds the applied tipsets to the export schedule
+	applied chan *types.TipSet
+
+	// ingest serializes the head changes, imports and backfills linking into the dag
+	ingest sync.Mutex
+	// objects keeps the object sweep out while backfills and imports write objects without
+	// holding the ingest lock
+	objects sync.RWMutex
+
+	// gcPending holds the pointers dropped from the source window until the gc loop releases
+	// them, gcNotify wakes the loop up
+	gcMu      sync.Mutex
+	gcPending []cid.Cid
+	gcNotify  chan struct{}
+	// swept is the oldest height of the window at the last object sweep, used by GC only
+	swept saaf.Height
 }
 
-func (s *Shutter) Run(ctx context.Context, doneCh <-chan struct{}, tsCh <-chan *types.TipSet) {
-	// update dag
-	go s.DAGUpdate(ctx, s.dag, s.src)
+// Jobs returns the export jobs of the daemon
+func (s *Shutter) Jobs() *ExportJobs {
+	return s.jobs
+}
+
+// Config returns the config the shutter runs with
+func (s *Shutter) Config() Config {
+	return s.cfg
+}
+
+func (s *Shutter) Run(ctx context.Context, doneCh <-chan struct{}, tsCh <-chan *lapi.HeadChange) {
+	// reclaim the nodes dropped from the source window
+	go s.runGC(ctx)
+
+	if s.cfg.Schedule.Enabled() {
+		go s.runSchedule(ctx)
+	}
+
+	if s.cfg.Backfill.Epochs > 0 {
+		if err := s.Backfill(ctx, s.cfg.Backfill.Epochs, s.cfg.Backfill.Parallelism); err != nil {
+			log.Warnf("failed to backfill err: %s", err)
+		}
+	}
 
 	for {
 		select {
 		case <-doneCh:
 			log.Info("quite head change loop")
 			return
-		case ts, ok := <-tsCh:
+		case change, ok := <-tsCh:
 			if !ok {
 				log.Warn("tsk chan closed")
 				return
 			}
 
-			log.Infow("incoming tipset", "height", ts.Height(), "tipset", ts)
-
-			// build snapshot dag
-			if err := s.DAGBuilder(ctx, ts, s.dag, s.src); err != nil {
-				log.Warnf("failed to build snapshot dag err: %s", err)
-			}
+			s.headChange(ctx, change)
 		}
 	}
 }
 
-func (s *Shutter) DAGBuilder(ctx context.Context, ts *types.TipSet, dag *saaf.DAG, src *saaf.SnapSource) error {
-	// add ts to source
-	rcids := s.src.AddSource(*ts)
+// headChange links an applied tipset, or unlinks a reverted one
+func (s *Shutter) headChange(ctx context.Context, change *lapi.HeadChange) {
+	s.ingest.Lock()
+	defer s.ingest.Unlock()
 
-	// remove cache cid
-	for _, rcid := range rcids {
-		err := s.cd.DeleteBlock(ctx, rcid)
-		if err != nil {
-			return err
+	ts := change.Val
+	if change.Type == store.HCRevert {
+		log.Infow("reverted tipset", "height", ts.Height(), "tipset", ts)
+
+		if err := s.Revert(ctx, ts); err != nil {
+			log.Warnf("failed to revert tipset err: %s", err)
 		}
+		s.recordStats(ctx)
+		return
 	}
 
+	log.Infow("incoming tipset", "height", ts.Height(), "tipset", ts)
+
+	if s.linked(ts) {
+		// every reconnect emits the current head again, linking it twice would leave a
+		// reference its revert does not drop
+		log.Debugw("tipset already linked", "height", ts.Height())
+		s.collect(s.src.AddSource(*ts))
+	} else if err := s.DAGBuilder(ctx, ts, s.dag, s.src); err != nil {
+		// build snapshot dag
+		log.Warnf("failed to build snapshot dag err: %s", err)
+	}
+
+	// re-ingest the epochs missed while disconnected or dropped by the head notifier
+	if err := s.CatchUp(ctx); err != nil {
+		log.Warnf("failed to catch up missed tipsets err: %s", err)
+	}
+
+	stats.Record(ctx, metrics.IngestHeight.M(int64(ts.Height())), metrics.IngestTipsets.M(1))
+	s.recordStats(ctx)
+	s.notifyApplied(ts)
+}
+
+// recordStats records the size of the source and the dag
+func (s *Shutter) recordStats(ctx context.Context) {
+	nodes, refs := s.dag.Stats()
+	stats.Record(ctx,
+		metrics.SourceHeights.M(int64(s.src.HpRange())),
+		metrics.DagNodes.M(int64(nodes)),
+		metrics.DagRefs.M(int64(refs)),
+	)
+}
+
+func (s *Shutter) DAGBuilder(ctx context.Context, ts *types.TipSet, dag *saaf.DAG, src *saaf.SnapSource) error {
+	if err := s.linkTipSet(ctx, ts, dag, src); err != nil {
+		return err
+	}
+
+	// fetch messages, receipts and state of the tipset
+	return s.fetchTipSet(ctx, ts)
+}
+
+// linkTipSet adds the tipset to the source, links its blocks into the dag and caches the headers
+func (s *Shutter) linkTipSet(ctx context.Context, ts *types.TipSet, dag *saaf.DAG, src *saaf.SnapSource) error {
+	// add ts to source
+	s.collect(src.AddSource(*ts))
+
 	cids := ts.Cids()
 
 	for _, cid := range cids {
@@ -129,24 +451,48 @@ func (s *Shutter) DAGBuilder(ctx context.Context, ts *types.TipSet, dag *saaf.DA
 	return nil
 }
 
-func (s *Shutter) DAGUpdate(ctx context.Context, dag *saaf.DAG, src *saaf.SnapSource) {
-	nodes := dag.Store()
-	nodeCh := nodes.All()
-
-	select {
-	case node := <-nodeCh:
-		pointer := node.Pointer()
-		cnt := dag.GetRefs(pointer)
-		if cnt == 0 {
-			// dag unlink
-			dag.Unlink(pointer)
-			// src remove
-			src.Remove(pointer)
-			// cache store remove
-			err := s.cd.DeleteBlock(ctx, pointer)
-			if err != nil {
-				log.Warnf("delete block from cache err: %s", err)
+// linkChain links the tipsets of chain, ordered from the newest, oldest first so parents are
+// resolvable when their children are linked. The tipsets still linked are only added to the
+// source again, in case their height entry was lost. It returns the tipsets it linked, the
+// caller holds the ingest lock.
+func (s *Shutter) linkChain(ctx context.Context, chain []*types.TipSet) ([]*types.TipSet, error) {
+	var fresh []*types.TipSet
+	for i := len(chain) - 1; i >= 0; i-- {
+		ts := chain[i]
+		if s.linked(ts) {
+			s.collect(s.src.AddSource(*ts))
+			continue
+		}
+
+		if err := s.linkTipSet(ctx, ts, s.dag, s.src); err != nil {
+			return fresh, xerrors.Errorf("link tipset at height %d: %w", ts.Height(), err)
+		}
+		fresh = append(fresh, ts)
+	}
+	return fresh, nil
+}
+
+// Revert unlinks a reverted tipset from the dag, removes it from the source and evicts its
+// headers from the cache. Messages and state are left in place, as the replacing tipset
+// usually shares them.
+func (s *Shutter) Revert(ctx context.Context, ts *types.TipSet) error {
+	if !s.src.RemoveTipSet(*ts) {
+		log.Debugw("reverted tipset is not the one recorded at its height", "height", ts.Height())
+	}
+
+	for _, c := range ts.Cids() {
+		if s.dag.GetRefs(c) > 0 {
+			if err := s.dag.Unlink(c); err != nil {
+				return err
+			}
+		}
+
+		if has, _ := s.cd.Has(ctx, c); has {
+			if err := s.cd.DeleteBlock(ctx, c); err != nil {
+				return err
 			}
 		}
 	}
+
+	return nil
 }
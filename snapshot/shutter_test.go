@@ -0,0 +1,417 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	lapi "github.com/filecoin-project/lotus/api"
+	lstore "github.com/filecoin-project/lotus/chain/store"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/internal/testutil"
+	"github.com/snapshot_snake/snapshot/saaf"
+	"github.com/snapshot_snake/snapshot/store"
+	"io"
+	"sync"
+	"testing"
+)
+
+func newTestShutter(t testing.TB, retention int) *Shutter {
+	t.Helper()
+	return newTestShutterCache(t, retention, store.DefaultCacheSize)
+}
+
+// newTestShutterCache builds a shutter whose memory cache holds up to size bytes
+func newTestShutterCache(t testing.TB, retention int, size int64) *Shutter {
+	t.Helper()
+
+	nodes := saaf.NewMapNodeStore()
+	dag := saaf.NewDAG(&nodes)
+	cs, err := store.NewCacheBlockStore(dag, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Retention.Epochs = int64(retention)
+	return New(context.Background(), cfg, nil, nil, cs, dag, saaf.NewSnapSource(retention))
+}
+
+// ingest links ts and caches its objects the way a head change does
+func ingest(t testing.TB, s *Shutter, ts *types.TipSet, objects map[cid.Cid][]blocks.Block) {
+	ctx := context.Background()
+
+	s.ingest.Lock()
+	defer s.ingest.Unlock()
+
+	if err := s.linkTipSet(ctx, ts, s.dag, s.src); err != nil {
+		t.Error(err)
+	}
+	for _, c := range ts.Cids() {
+		for _, obj := range objects[c] {
+			if err := s.cd.Put(ctx, obj.Cid(), obj); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+// drainGC releases the pointers queued for the gc loop
+func drainGC(t testing.TB, s *Shutter) {
+	s.gcMu.Lock()
+	pending := s.gcPending
+	s.gcPending = nil
+	s.gcMu.Unlock()
+
+	if _, _, err := s.GC(context.Background(), pending); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestRace(t *testing.T) {
+	const retention = 20
+
+	s := newTestShutter(t, retention)
+	chain, objects := testutil.Chain(t, 150)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gcDone := make(chan struct{})
+	go func() {
+		defer close(gcDone)
+		s.runGC(ctx)
+	}()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for i, ts := range chain {
+			ingest(t, s, ts, objects)
+
+			// revert and apply again every few tipsets
+			if i%9 == 8 {
+				s.ingest.Lock()
+				if err := s.Revert(ctx, ts); err != nil {
+					t.Error(err)
+				}
+				s.ingest.Unlock()
+				ingest(t, s, ts, objects)
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// what the GetDagNode and GetCacheRange rpc handlers read
+				latest := s.src.Latest()
+				s.src.HpRange()
+				if len(latest) == 0 {
+					continue
+				}
+
+				ts, err := s.sourceTipSet(latest)
+				if err != nil {
+					// reverted meanwhile
+					continue
+				}
+				err = s.runExport(ctx, JobSourceRPC, ts, io.Discard, func(ctx context.Context, w io.Writer) error {
+					return store.Export(ctx, s.cd, s.dag, ts, w, 5)
+				})
+				if err != nil {
+					t.Errorf("export at height %d: %s", ts.Height(), err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	cancel()
+	<-gcDone
+	drainGC(t, s)
+
+	if got := s.src.HpRange(); got != retention {
+		t.Fatalf("source holds %d heights, want %d", got, retention)
+	}
+	if nodes, _ := s.dag.Stats(); nodes != retention {
+		t.Fatalf("dag holds %d nodes, want %d", nodes, retention)
+	}
+}
+
+// hookStore runs hook before the first Get, while an export walks the store
+type hookStore struct {
+	common.DagStore
+	once sync.Once
+	hook func()
+}
+
+func (h *hookStore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	h.once.Do(h.hook)
+	return h.DagStore.Get(ctx, c)
+}
+
+func TestExportConsistentWhileUnlinking(t *testing.T) {
+	const retention = 30
+
+	s := newTestShutter(t, retention)
+	s.cfg.Retention.SweepEpochs = 1
+	chain, objects := testutil.Chain(t, 40)
+	for _, ts := range chain[:retention] {
+		ingest(t, s, ts, objects)
+	}
+	ts := chain[retention-1]
+
+	// move the window by 10 tipsets once the export started, releasing the oldest headers
+	// from the dag and the cache
+	bs := &hookStore{DagStore: s.cd, hook: func() {
+		for _, next := range chain[retention:] {
+			ingest(t, s, next, objects)
+		}
+		drainGC(t, s)
+	}}
+
+	var buf bytes.Buffer
+	if err := store.Export(context.Background(), bs, s.dag, ts, &buf, retention); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := s.cd.Has(context.Background(), chain[0].Cids()[0]); has {
+		t.Fatal("released header is still cached")
+	}
+	if nodes, _ := s.dag.Stats(); nodes != retention {
+		t.Fatalf("dag holds %d nodes, want %d", nodes, retention)
+	}
+
+	cr, err := car.NewCarReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := cid.NewSet()
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported.Add(blk.Cid())
+	}
+
+	for _, ts := range chain[:retention] {
+		for _, c := range ts.Cids() {
+			if !exported.Has(c) {
+				t.Fatalf("header at height %d missing from the export", ts.Height())
+			}
+		}
+	}
+	for _, ts := range chain[retention:] {
+		if exported.Has(ts.Cids()[0]) {
+			t.Fatalf("header at height %d linked after the export started is exported", ts.Height())
+		}
+	}
+	if want := retention * 4; exported.Len() != want {
+		t.Fatalf("exported %d blocks, want %d", exported.Len(), want)
+	}
+}
+
+func TestSweepObjects(t *testing.T) {
+	const retention = 20
+
+	s := newTestShutter(t, retention)
+	s.cfg.Retention.SweepEpochs = 5
+	chain, objects := testutil.Chain(t, 50)
+
+	// the first gc sweeps
+	for _, ts := range chain[:retention+1] {
+		ingest(t, s, ts, objects)
+	}
+	_, blocks, err := s.GC(context.Background(), chain[0].Cids())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + 3; blocks != want {
+		t.Fatalf("gc deleted %d blocks, want %d", blocks, want)
+	}
+
+	// the window moves less than SweepEpochs
+	for _, ts := range chain[retention+1 : retention+4] {
+		ingest(t, s, ts, objects)
+	}
+	drainGC(t, s)
+	if has, _ := s.cd.Has(context.Background(), objects[chain[1].Cids()[0]][0].Cid()); !has {
+		t.Fatal("objects swept before the window moved SweepEpochs")
+	}
+
+	for _, ts := range chain[retention+4:] {
+		ingest(t, s, ts, objects)
+	}
+	drainGC(t, s)
+
+	for i, ts := range chain {
+		for _, obj := range objects[ts.Cids()[0]] {
+			has, _ := s.cd.Has(context.Background(), obj.Cid())
+			if want := i >= len(chain)-retention; has != want {
+				t.Fatalf("object of height %d cached: %t, want %t", ts.Height(), has, want)
+			}
+		}
+	}
+}
+
+func TestSweepKeepsExportedObjects(t *testing.T) {
+	const retention = 20
+
+	s := newTestShutter(t, retention)
+	s.cfg.Retention.SweepEpochs = 1
+	chain, objects := testutil.Chain(t, 31)
+	for _, ts := range chain[:retention] {
+		ingest(t, s, ts, objects)
+	}
+	ts := chain[retention-1]
+	dropped := objects[chain[0].Cids()[0]][0].Cid()
+
+	// move the window once the export started and sweep while it walks the objects of the
+	// dropped tipsets, the sweep does not wait for the export
+	bs := &hookStore{DagStore: s.cd, hook: func() {
+		for _, next := range chain[retention : len(chain)-1] {
+			ingest(t, s, next, objects)
+		}
+		drainGC(t, s)
+		if has, _ := s.cd.Has(context.Background(), dropped); !has {
+			t.Error("objects walked by the export are swept")
+		}
+	}}
+
+	var buf bytes.Buffer
+	err := s.runExport(context.Background(), JobSourceRPC, ts, &buf, func(ctx context.Context, w io.Writer) error {
+		return store.Export(ctx, bs, s.dag, ts, w, retention)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the next sweep reclaims them
+	ingest(t, s, chain[len(chain)-1], objects)
+	drainGC(t, s)
+	if has, _ := s.cd.Has(context.Background(), dropped); has {
+		t.Fatal("objects out of the window are still cached after the export")
+	}
+}
+
+func TestSweepPostponedWhileWriting(t *testing.T) {
+	const retention = 20
+
+	s := newTestShutter(t, retention)
+	s.cfg.Retention.SweepEpochs = 1
+	chain, objects := testutil.Chain(t, 22)
+	for _, ts := range chain[:retention+1] {
+		ingest(t, s, ts, objects)
+	}
+	dropped := objects[chain[0].Cids()[0]][0].Cid()
+
+	// an import writes objects
+	s.objects.RLock()
+	drainGC(t, s)
+	s.objects.RUnlock()
+	if has, _ := s.cd.Has(context.Background(), dropped); !has {
+		t.Fatal("objects swept while an import writes objects")
+	}
+
+	ingest(t, s, chain[retention+1], objects)
+	drainGC(t, s)
+	if has, _ := s.cd.Has(context.Background(), dropped); has {
+		t.Fatal("postponed sweep did not run on the next gc")
+	}
+}
+
+func TestHeadChangeRelinkedHead(t *testing.T) {
+	const retention = 20
+
+	s := newTestShutter(t, retention)
+	chain, objects := testutil.Chain(t, 25)
+	full := testutil.NewFullNode()
+	full.AddChain(chain, objects)
+	s.full = full
+
+	ctx := context.Background()
+	for _, ts := range chain {
+		s.headChange(ctx, &lapi.HeadChange{Type: lstore.HCApply, Val: ts})
+	}
+	head := chain[len(chain)-1]
+
+	// two reconnects emit the head again
+	for i := 0; i < 2; i++ {
+		s.headChange(ctx, &lapi.HeadChange{Type: lstore.HCCurrent, Val: head})
+	}
+	drainGC(t, s)
+	if nodes, refs := s.dag.Stats(); nodes != retention || refs != 2*retention-1 {
+		t.Fatalf("dag holds %d nodes with %d refs, want %d with %d", nodes, refs, retention, 2*retention-1)
+	}
+
+	s.headChange(ctx, &lapi.HeadChange{Type: lstore.HCRevert, Val: head})
+	if nodes, refs := s.dag.Stats(); nodes != retention-1 || refs != 2*retention-3 {
+		t.Fatalf("dag holds %d nodes with %d refs after the revert, want %d with %d", nodes, refs, retention-1, 2*retention-3)
+	}
+	if s.dag.GetRefs(head.Cids()[0]) != 0 {
+		t.Fatal("reverted head is still linked")
+	}
+}
+
+func TestHeadChangeAfterBackfill(t *testing.T) {
+	const retention = 20
+
+	s := newTestShutter(t, retention)
+	chain, objects := testutil.Chain(t, 25)
+	full := testutil.NewFullNode()
+	full.AddChain(chain, objects)
+	s.full = full
+
+	ctx := context.Background()
+	if err := s.Backfill(ctx, retention, 1); err != nil {
+		t.Fatal(err)
+	}
+	s.headChange(ctx, &lapi.HeadChange{Type: lstore.HCCurrent, Val: chain[len(chain)-1]})
+
+	if nodes, refs := s.dag.Stats(); nodes != retention || refs != 2*retention-1 {
+		t.Fatalf("dag holds %d nodes with %d refs, want %d with %d", nodes, refs, retention, 2*retention-1)
+	}
+}
+
+func TestLoadTipSetEvicted(t *testing.T) {
+	const retention = 20
+
+	// a cache holding a few blocks
+	s := newTestShutterCache(t, retention, 1024)
+
+	chain, objects := testutil.Chain(t, retention)
+	for _, ts := range chain {
+		ingest(t, s, ts, objects)
+	}
+	if has, _ := s.cd.Has(context.Background(), chain[0].Cids()[0]); has {
+		t.Fatal("oldest header is still cached")
+	}
+
+	ts, err := s.LoadTipSet(chain[0].Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Key() != chain[0].Key() {
+		t.Fatalf("loaded tipset %s, want %s", ts.Key(), chain[0].Key())
+	}
+}
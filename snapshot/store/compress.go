@@ -0,0 +1,115 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/snapshot_snake/common"
+	"io"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// CheckCompression validates a compression name
+func CheckCompression(compression string) error {
+	switch compression {
+	case "", CompressionNone, CompressionZstd, CompressionGzip:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression %q, expect %s, %s or %s", compression, CompressionNone, CompressionZstd, CompressionGzip)
+	}
+}
+
+// CompressionExt returns the file extension appended to compressed snapshots
+func CompressionExt(compression string) string {
+	switch compression {
+	case CompressionZstd:
+		return ".zst"
+	case CompressionGzip:
+		return ".gz"
+	default:
+		return ""
+	}
+}
+
+// Compress wraps w in a streaming compressor. The returned writer must be closed
+// to flush the compressed stream, closing does not close w.
+func Compress(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", CompressionNone:
+		return nopCloser{w}, nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, CheckCompression(compression)
+	}
+}
+
+// WriteCompressed writes the CARv1 stream produced by write in the given format through a
+// streaming compressor
+func WriteCompressed(w io.Writer, format, compression string, write CarWriter) error {
+	cw, err := Compress(w, compression)
+	if err != nil {
+		return err
+	}
+
+	err = WriteFormat(cw, format, write)
+	if cerr := cw.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("flush %s stream: %w", compression, cerr)
+	}
+
+	return err
+}
+
+// ExportCompressed writes the snapshot of ts in the given format through a streaming compressor
+func ExportCompressed(ctx context.Context, bs common.DagStore, ts *types.TipSet, w io.Writer, rs int64, format, compression string) error {
+	return WriteCompressed(w, format, compression, func(w io.Writer) error {
+		return bs.Export(ctx, ts, w, rs)
+	})
+}
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// Decompress detects a zstd or gzip stream by its magic bytes and returns a reader of the
+// decompressed payload, other streams are returned as is
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("peek stream magic: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
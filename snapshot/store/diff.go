@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/snapshot/saaf"
+	"golang.org/x/xerrors"
+	"io"
+	"time"
+)
+
+// DiffManifest describes a delta snapshot, consumers apply it on top of the full snapshot
+// whose roots are recorded as the base
+type DiffManifest struct {
+	BaseRoots        []cid.Cid
+	BaseHeight       abi.ChainEpoch
+	Roots            []cid.Cid
+	Height           abi.ChainEpoch
+	RecentStateroots int64
+	Format           string
+	Compression      string
+}
+
+// ExportDiff writes the blocks of the snapshot of to which are not part of the snapshot of from
+// as a CARv1 into w, both snapshots include rs recent state roots
+func ExportDiff(ctx context.Context, bs common.DagStore, dag *saaf.DAG, from, to *types.TipSet, w io.Writer, rs int64) error {
+	if from.Height() >= to.Height() {
+		return xerrors.Errorf("base tipset height %d is not below target height %d", from.Height(), to.Height())
+	}
+
+	base := cid.NewSet()
+	err := WalkSnapshot(ctx, bs, dag, from, rs, func(c cid.Cid, _ blocks.Block) error {
+		base.Add(c)
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("walk base snapshot: %w", err)
+	}
+
+	h := &car.CarHeader{
+		Roots:   to.Cids(),
+		Version: 1,
+	}
+
+	if err := car.WriteHeader(h, w); err != nil {
+		return xerrors.Errorf("failed to write car header: %s", err)
+	}
+
+	begin := time.Now()
+	var written, size int64
+	err = WalkSnapshot(ctx, bs, dag, to, rs, func(c cid.Cid, blk blocks.Block) error {
+		if base.Has(c) {
+			return nil
+		}
+
+		if blk == nil {
+			var err error
+			if blk, err = bs.Get(ctx, c); err != nil {
+				return xerrors.Errorf("writing object to car, bs.Get: %w", err)
+			}
+		}
+
+		if err := carutil.LdWrite(w, c.Bytes(), blk.RawData()); err != nil {
+			return xerrors.Errorf("failed to write block to car output: %w", err)
+		}
+
+		written++
+		size += int64(len(c.Bytes()) + len(blk.RawData()))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infow("diff export finished", "base", base.Len(), "written", written)
+	recordExport(ctx, "diff", begin, written, size)
+	return nil
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/snapshot_snake/snapshot/saaf"
+	"io"
+)
+
+// NewDiskBlockStore opens (or creates) a leveldb backed dag store at path
+func NewDiskBlockStore(dag *saaf.DAG, path string) (*DiskBlockStore, error) {
+	ds, err := leveldb.NewDatastore(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open leveldb at %s: %w", path, err)
+	}
+
+	res := &DiskBlockStore{
+		dag: dag,
+		ds:  ds,
+	}
+
+	return res, nil
+}
+
+// DiskBlockStore keeps blocks on disk keyed by cid, so the cache survives restarts
+type DiskBlockStore struct {
+	dag *saaf.DAG
+	ds  *leveldb.Datastore
+}
+
+func dsKey(c cid.Cid) datastore.Key {
+	return dshelp.NewKeyFromBinary(c.Bytes())
+}
+
+func (dbs *DiskBlockStore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	data, err := dbs.ds.Get(ctx, dsKey(c))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, fmt.Errorf("cid %s not in store", c)
+		}
+		return nil, fmt.Errorf("get %s from store: %w", c, err)
+	}
+
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func (dbs *DiskBlockStore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return dbs.ds.Has(ctx, dsKey(c))
+}
+
+func (dbs *DiskBlockStore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	return dbs.ds.Delete(ctx, dsKey(c))
+}
+
+func (dbs *DiskBlockStore) Put(ctx context.Context, c cid.Cid, block blocks.Block) error {
+	return dbs.ds.Put(ctx, dsKey(c), block.RawData())
+}
+
+// AllKeysChan sends the cids of the blocks on disk
+func (dbs *DiskBlockStore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	res, err := dbs.ds.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("query store keys: %w", err)
+	}
+
+	ch := make(chan cid.Cid)
+	go func() {
+		defer close(ch)
+		defer res.Close() //nolint:errcheck
+
+		for r := range res.Next() {
+			if r.Error != nil {
+				log.Errorf("query store keys: %s", r.Error)
+				return
+			}
+			data, err := dshelp.BinaryFromDsKey(datastore.RawKey(r.Key))
+			if err != nil {
+				log.Warnf("decode store key %s: %s", r.Key, err)
+				continue
+			}
+			c, err := cid.Cast(data)
+			if err != nil {
+				log.Warnf("decode store key %s: %s", r.Key, err)
+				continue
+			}
+
+			select {
+			case ch <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (dbs *DiskBlockStore) Export(ctx context.Context, ts *types.TipSet, w io.Writer, rs int64) error {
+	return Export(ctx, dbs, dbs.dag, ts, w, rs)
+}
+
+func (dbs *DiskBlockStore) ExportDiff(ctx context.Context, from, to *types.TipSet, w io.Writer, rs int64) error {
+	return ExportDiff(ctx, dbs, dbs.dag, from, to, w, rs)
+}
+
+func (dbs *DiskBlockStore) Close() error {
+	return dbs.ds.Close()
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	carv2 "github.com/ipld/go-car/v2"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+)
+
+const (
+	FormatCarV1 = "carv1"
+	FormatCarV2 = "carv2"
+)
+
+// CheckFormat validates an export format name
+func CheckFormat(format string) error {
+	switch format {
+	case "", FormatCarV1, FormatCarV2:
+		return nil
+	default:
+		return fmt.Errorf("unknown export format %q, expect %s or %s", format, FormatCarV1, FormatCarV2)
+	}
+}
+
+// CarWriter writes a CARv1 stream into w
+type CarWriter func(w io.Writer) error
+
+// WriteFormat writes the CARv1 stream produced by write into w in the given format
+func WriteFormat(w io.Writer, format string, write CarWriter) error {
+	if err := CheckFormat(format); err != nil {
+		return err
+	}
+
+	if format == FormatCarV2 {
+		return WriteCarV2(w, write)
+	}
+	return write(w)
+}
+
+// WriteCarV2 writes the CARv1 stream produced by write as a CARv2 with an index section.
+// The CARv1 payload is spooled to a temporary file first, as the CARv2 header records its
+// size up front.
+func WriteCarV2(w io.Writer, write CarWriter) error {
+	tmp, err := os.CreateTemp("", "snapshot-*.car")
+	if err != nil {
+		return xerrors.Errorf("create temp car file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	defer tmp.Close()           //nolint:errcheck
+
+	bw := bufio.NewWriterSize(tmp, 1<<20)
+	if err := write(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return xerrors.Errorf("flush temp car file: %w", err)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return xerrors.Errorf("seek temp car file: %w", err)
+	}
+
+	if err := carv2.WrapV1(tmp, w); err != nil {
+		return xerrors.Errorf("wrap carv1 into carv2: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"github.com/filecoin-project/go-state-types/abi"
+	"io"
+	"sync/atomic"
+)
+
+// Progress tracks an export as it walks the snapshot, it is carried by the export context
+type Progress struct {
+	// Blocks is the number of objects walked
+	Blocks atomic.Int64
+	// Height is the height of the last header walked
+	Height atomic.Int64
+	// Bytes is the number of bytes written to the export stream
+	Bytes atomic.Int64
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context reporting the progress of the exports run with it into p
+func WithProgress(ctx context.Context, p *Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+func progressFrom(ctx context.Context) *Progress {
+	p, _ := ctx.Value(progressKey{}).(*Progress)
+	return p
+}
+
+func (p *Progress) walked(height abi.ChainEpoch) {
+	if p == nil {
+		return
+	}
+	p.Height.Store(int64(height))
+}
+
+func (p *Progress) block() {
+	if p == nil {
+		return
+	}
+	p.Blocks.Add(1)
+}
+
+// Writer counts the bytes written through it into p
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	return &progressWriter{w: w, p: p}
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *Progress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.Bytes.Add(int64(n))
+	return n, err
+}
@@ -1,56 +1,73 @@
 package store
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"github.com/filecoin-project/go-state-types/abi"
-	"github.com/filecoin-project/lotus/build"
 	"github.com/filecoin-project/lotus/chain/types"
 	lru "github.com/hashicorp/golang-lru"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
-	"github.com/ipld/go-car"
-	carutil "github.com/ipld/go-car/util"
-	"github.com/multiformats/go-multicodec"
-	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/lib/metrics"
 	"github.com/snapshot_snake/snapshot/saaf"
-	typegen "github.com/whyrusleeping/cbor-gen"
-	"golang.org/x/xerrors"
+	"go.opencensus.io/stats"
 	"io"
+	"math"
+	"sync/atomic"
 )
 
-var DefaultBlkCacheCacheSize = 8192
+// DefaultCacheSize is the default size of the memory cache in bytes
+const DefaultCacheSize = 4 << 30
 
 var log = logging.Logger("store")
 
-const HEIGHT_COUNT = 10
-
-func NewCacheBlockStore(dag *saaf.DAG) (*CacheBlockStore, error) {
-	cache, err := lru.New2Q(DefaultBlkCacheCacheSize)
-	if err != nil {
-		return nil, err
+// NewCacheBlockStore creates a memory cache holding up to size bytes of block data, the least
+// recently used blocks are evicted past it
+func NewCacheBlockStore(dag *saaf.DAG, size int64) (*CacheBlockStore, error) {
+	if size <= 0 {
+		size = DefaultCacheSize
 	}
 
 	res := &CacheBlockStore{
-		dag:   dag,
-		cache: cache,
+		dag:     dag,
+		maxSize: size,
 	}
 
+	// the number of entries is bounded by the size in bytes instead
+	cache, err := lru.NewWithEvict(math.MaxInt, res.onEvict)
+	if err != nil {
+		return nil, err
+	}
+	res.cache = cache
+
 	return res, nil
 }
 
 type CacheBlockStore struct {
 	dag   *saaf.DAG
-	cache *lru.TwoQueueCache
+	cache *lru.Cache
+
+	// size is the number of bytes of block data held, the evict callback runs outside the
+	// cache lock so it is updated atomically
+	size    atomic.Int64
+	maxSize int64
+
+	// spill receives the evicted blocks before they leave the cache, when set
+	spill func(context.Context, cid.Cid, blocks.Block) error
+}
+
+// onEvict accounts for removed and evicted blocks
+func (cbs *CacheBlockStore) onEvict(_ interface{}, value interface{}) {
+	cbs.size.Add(-int64(len(value.(blocks.Block).RawData())))
 }
 
 func (cbs *CacheBlockStore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
 	has, err := cbs.Has(ctx, c)
 	if !has {
+		stats.Record(ctx, metrics.CacheMisses.M(1))
 		return nil, err
 	}
+	stats.Record(ctx, metrics.CacheHits.M(1))
 
 	value, ok := cbs.cache.Get(c)
 	if !ok {
@@ -78,214 +95,60 @@ func (cbs *CacheBlockStore) DeleteBlock(ctx context.Context, c cid.Cid) error {
 }
 
 func (cbs *CacheBlockStore) Put(ctx context.Context, c cid.Cid, block blocks.Block) error {
-	var err error
-	// cid - block
-	has, _ := cbs.Has(ctx, c)
-	if has {
-		return fmt.Errorf("has cid %s in cache", c)
-	}
-	log.Infof("add cid %s to cache", c)
-	cbs.cache.Add(c, block)
-
-	var b types.BlockHeader
-	if err = b.UnmarshalCBOR(bytes.NewBuffer(block.RawData())); err != nil {
-		return err
-	} else {
-		// block messages - block
-		has, _ := cbs.Has(ctx, b.Messages)
-		if has {
-			log.Infof("has messages %s in cache", b.Messages)
-
-		} else {
-			log.Infof("add messages %s to cache", b.Messages)
-			cbs.cache.Add(b.Messages, block)
-		}
-
-		// block messageReceipts - block
-		has, _ = cbs.Has(ctx, b.ParentMessageReceipts)
-		if has {
-			log.Warnf("has parentmessagereceipts %s in cache", b.ParentMessageReceipts)
-		} else {
-			log.Infof("add parentmessagereceipts %s to cache", b.ParentMessageReceipts)
-			cbs.cache.Add(b.ParentMessageReceipts, block)
-		}
-
-		// block parentStateRoot - block
-		has, _ = cbs.Has(ctx, b.ParentStateRoot)
-		if has {
-			log.Warnf("has parentstateroot %s in cache", b.ParentStateRoot)
-		} else {
-			log.Infof("add parentstateroot %s to cache", b.ParentStateRoot)
-			cbs.cache.Add(b.ParentStateRoot, block)
-		}
-	}
-
-	return err
-}
-
-func (cbs *CacheBlockStore) Export(ctx context.Context, ts *types.TipSet, w io.Writer, rs int64) error {
-	h := &car.CarHeader{
-		Roots:   ts.Cids(),
-		Version: 1,
-	}
-
-	if err := car.WriteHeader(h, w); err != nil {
-		return xerrors.Errorf("failed to write car header: %s", err)
-	}
-
-	return cbs.WalkSnapshot(ctx, ts, rs, func(c cid.Cid) error {
-		blk, err := cbs.Get(ctx, c)
-		if err != nil {
-			log.Errorf("cid ====> %s", c)
-			return xerrors.Errorf("writing object to car, bs.Get: %w", err)
-		}
-
-		if err := carutil.LdWrite(w, c.Bytes(), blk.RawData()); err != nil {
-			return xerrors.Errorf("failed to write block to car output: %w", err)
-		}
-
-		return nil
-	})
-}
-
-func (cbs *CacheBlockStore) WalkSnapshot(ctx context.Context, ts *types.TipSet, rs int64, cb func(cid.Cid) error) error {
-	seen := cid.NewSet()
-	walked := cid.NewSet()
-
-	blocksToWalk := ts.Cids()
-
-	walkDAG := func(blk cid.Cid) error {
-		if !seen.Visit(blk) {
-			return nil
-		}
-
-		if err := cb(blk); err != nil {
-			return err
-		}
-
-		data, err := cbs.Get(ctx, blk)
-		if err != nil {
-			return xerrors.Errorf("getting block: %w", err)
-		}
-
-		var b types.BlockHeader
-		if err := b.UnmarshalCBOR(bytes.NewBuffer(data.RawData())); err != nil {
-			return xerrors.Errorf("unmarshaling block header (cid=%s): %w", blk, err)
-		}
-
-		var cids []cid.Cid
-		nodes := cbs.dag.Store()
-		store := nodes.(*saaf.MapNodeStore)
-		node, err := store.Get(blk)
-		n := node.(*saaf.SnapNode)
-
-		for _, pointer := range n.Parents() {
-			blocksToWalk = append(blocksToWalk, pointer)
-		}
-
-		if b.Height > ts.Height()-abi.ChainEpoch(rs) {
-			if walked.Visit(b.Messages) {
-				mcids, err := recurseLinks(ctx, cbs, walked, b.Messages, []cid.Cid{b.Messages})
-				if err != nil {
-					return xerrors.Errorf("cid %s, bid %s, bid.msg %s, recursing messages failed: %w", blk, b.Cid(), b.Messages, err)
-				}
-				cids = mcids
-			}
-		}
-
-		out := cids
-
-		if b.Height == 0 || b.Height > ts.Height()-abi.ChainEpoch(rs) {
-			if walked.Visit(b.ParentStateRoot) {
-				cids, err := recurseLinks(ctx, cbs, walked, b.ParentStateRoot, []cid.Cid{b.ParentStateRoot})
-				if err != nil {
-					return xerrors.Errorf("recursing genesis state failed: %w", err)
-				}
-
-				out = append(out, cids...)
-			}
-
-			if walked.Visit(b.ParentMessageReceipts) {
-				out = append(out, b.ParentMessageReceipts)
-			}
-		}
-
-		for _, c := range out {
-			if seen.Visit(c) {
-				prefix := c.Prefix()
-
-				// Don't include identity CIDs.
-				if multicodec.Code(prefix.MhType) == multicodec.Identity {
-					continue
-				}
-
-				// We only include raw, cbor, and dagcbor, for now.
-				switch multicodec.Code(prefix.Codec) {
-				case multicodec.Cbor, multicodec.DagCbor, multicodec.Raw:
-				default:
-					continue
-				}
-
-				if err := cb(c); err != nil {
-					return err
-				}
-
-			}
-		}
-
+	// cid - block, messages, receipts and state objects are fetched and put under their own cids
+	if has, _ := cbs.cache.ContainsOrAdd(c, block); has {
 		return nil
 	}
-
-	log.Infow("export started")
-	exportStart := build.Clock.Now()
-
-	for len(blocksToWalk) > 0 {
-		next := blocksToWalk[0]
-		blocksToWalk = blocksToWalk[1:]
-		if err := walkDAG(next); err != nil {
-			return xerrors.Errorf("walk chain failed: %w", err)
+	log.Debugf("add cid %s to cache", c)
+	cbs.size.Add(int64(len(block.RawData())))
+
+	var evicted int64
+	defer func() {
+		if evicted > 0 {
+			stats.Record(ctx, metrics.CacheEvictions.M(evicted))
+		}
+	}()
+	for cbs.size.Load() > cbs.maxSize {
+		k, v, ok := cbs.cache.GetOldest()
+		if !ok {
+			break
+		}
+		// spill before removing, so the block is always held by one of the tiers
+		if cbs.spill != nil {
+			if err := cbs.spill(ctx, k.(cid.Cid), v.(blocks.Block)); err != nil {
+				return fmt.Errorf("spill %s: %w", k, err)
+			}
 		}
+		cbs.cache.Remove(k)
+		evicted++
 	}
-
-	log.Infow("export finished", "duration", build.Clock.Now().Sub(exportStart).Seconds())
+	stats.Record(ctx, metrics.CacheSize.M(int64(cbs.cache.Len())), metrics.CacheBytes.M(cbs.size.Load()))
 
 	return nil
 }
 
-func recurseLinks(ctx context.Context, bs common.DagStore, walked *cid.Set, root cid.Cid, in []cid.Cid) ([]cid.Cid, error) {
-	if multicodec.Code(root.Prefix().Codec) != multicodec.DagCbor {
-		return in, nil
-	}
-
-	data, err := bs.Get(ctx, root)
-	if err != nil {
-		log.Errorf("recurseLinks end %s not in cache", root)
-		return in, nil
-	}
-
-	in = append(in, root)
-
-	var rerr error
-	err = typegen.ScanForLinks(bytes.NewReader(data.RawData()), func(c cid.Cid) {
-		if rerr != nil {
-			// No error return on ScanForLinks :(
-			return
-		}
-
-		// traversed this already...
-		if !walked.Visit(c) {
-			return
+// AllKeysChan sends the cids of the cached blocks, as cached when it is called
+func (cbs *CacheBlockStore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	keys := cbs.cache.Keys()
+
+	ch := make(chan cid.Cid)
+	go func() {
+		defer close(ch)
+		for _, k := range keys {
+			select {
+			case ch <- k.(cid.Cid):
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+	return ch, nil
+}
 
-		var err error
-		in, err = recurseLinks(ctx, bs, walked, c, in)
-		if err != nil {
-			rerr = err
-		}
-	})
-	if err != nil {
-		return nil, xerrors.Errorf("scanning for links failed: %w", err)
-	}
+func (cbs *CacheBlockStore) Export(ctx context.Context, ts *types.TipSet, w io.Writer, rs int64) error {
+	return Export(ctx, cbs, cbs.dag, ts, w, rs)
+}
 
-	return in, rerr
+func (cbs *CacheBlockStore) ExportDiff(ctx context.Context, from, to *types.TipSet, w io.Writer, rs int64) error {
+	return ExportDiff(ctx, cbs, cbs.dag, from, to, w, rs)
 }
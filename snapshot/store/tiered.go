@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/snapshot_snake/lib/metrics"
+	"github.com/snapshot_snake/snapshot/saaf"
+	"go.opencensus.io/stats"
+	"io"
+	"os"
+	"sync"
+)
+
+// NewTieredBlockStore creates a dag store holding up to size bytes of blocks in memory and
+// spilling the evicted blocks into a leveldb at path. The disk tier only backs the memory tier
+// of a single run, it is cleared on open.
+func NewTieredBlockStore(dag *saaf.DAG, size int64, path string) (*TieredBlockStore, error) {
+	if err := os.RemoveAll(path); err != nil {
+		return nil, fmt.Errorf("clear spill store at %s: %w", path, err)
+	}
+
+	mem, err := NewCacheBlockStore(dag, size)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := NewDiskBlockStore(dag, path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &TieredBlockStore{
+		dag:  dag,
+		mem:  mem,
+		disk: disk,
+	}
+	mem.spill = res.spill
+
+	return res, nil
+}
+
+// TieredBlockStore keeps the recently used blocks in a byte bounded memory tier and the blocks
+// evicted from it on disk, reads from the disk tier promote the blocks back into memory
+type TieredBlockStore struct {
+	dag  *saaf.DAG
+	mem  *CacheBlockStore
+	disk *DiskBlockStore
+
+	// mu serializes the writes, so a block deleted from both tiers is not spilled back to disk
+	mu sync.Mutex
+}
+
+// spill writes a block evicted from the memory tier to disk, the caller holds the lock
+func (tbs *TieredBlockStore) spill(ctx context.Context, c cid.Cid, block blocks.Block) error {
+	// promoted blocks are still on disk
+	if has, _ := tbs.disk.Has(ctx, c); has {
+		return nil
+	}
+
+	stats.Record(ctx, metrics.CacheSpills.M(1))
+	return tbs.disk.Put(ctx, c, block)
+}
+
+func (tbs *TieredBlockStore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if block, err := tbs.mem.Get(ctx, c); err == nil {
+		return block, nil
+	}
+
+	block, err := tbs.disk.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	tbs.mu.Lock()
+	defer tbs.mu.Unlock()
+
+	// deleted meanwhile
+	if has, _ := tbs.disk.Has(ctx, c); !has {
+		return block, nil
+	}
+	stats.Record(ctx, metrics.CachePromotions.M(1))
+	if err := tbs.mem.Put(ctx, c, block); err != nil {
+		log.Warnf("promote %s to memory err: %s", c, err)
+	}
+
+	return block, nil
+}
+
+func (tbs *TieredBlockStore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if has, _ := tbs.mem.Has(ctx, c); has {
+		return true, nil
+	}
+	return tbs.disk.Has(ctx, c)
+}
+
+func (tbs *TieredBlockStore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	tbs.mu.Lock()
+	defer tbs.mu.Unlock()
+
+	// the memory tier errors on blocks it does not hold
+	_ = tbs.mem.DeleteBlock(ctx, c)
+	return tbs.disk.DeleteBlock(ctx, c)
+}
+
+func (tbs *TieredBlockStore) Put(ctx context.Context, c cid.Cid, block blocks.Block) error {
+	tbs.mu.Lock()
+	defer tbs.mu.Unlock()
+
+	return tbs.mem.Put(ctx, c, block)
+}
+
+// AllKeysChan sends the cids of the blocks in memory, then the ones on disk. Promoted blocks
+// are held by both tiers and sent twice.
+func (tbs *TieredBlockStore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	mem, err := tbs.mem.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := tbs.disk.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan cid.Cid)
+	go func() {
+		defer close(ch)
+		for _, keys := range []<-chan cid.Cid{mem, disk} {
+			for c := range keys {
+				select {
+				case ch <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (tbs *TieredBlockStore) Export(ctx context.Context, ts *types.TipSet, w io.Writer, rs int64) error {
+	return Export(ctx, tbs, tbs.dag, ts, w, rs)
+}
+
+func (tbs *TieredBlockStore) ExportDiff(ctx context.Context, from, to *types.TipSet, w io.Writer, rs int64) error {
+	return ExportDiff(ctx, tbs, tbs.dag, from, to, w, rs)
+}
+
+func (tbs *TieredBlockStore) Close() error {
+	return tbs.disk.Close()
+}
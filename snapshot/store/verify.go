@@ -0,0 +1,294 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/multiformats/go-multicodec"
+	"github.com/snapshot_snake/common"
+	typegen "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+)
+
+// VerifyReport is the result of verifying a snapshot car
+type VerifyReport struct {
+	Roots  []cid.Cid
+	Height abi.ChainEpoch
+	// Blocks is the number of blocks in the car
+	Blocks int
+	// Headers is the number of block headers reached from the roots
+	Headers int
+	// TruncatedAt is the lowest height reached whose parents are not in the car, -1 when
+	// the chain reaches genesis
+	TruncatedAt abi.ChainEpoch
+	// Corrupted blocks do not hash to their cid, they are neither missing nor extra
+	Corrupted []cid.Cid
+	// Missing blocks are linked from the roots within the recent state roots window but not in the car
+	Missing []cid.Cid
+	// Extra blocks are in the car but not reachable from the roots
+	Extra []cid.Cid
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Corrupted) == 0 && len(r.Missing) == 0 && len(r.Extra) == 0
+}
+
+// Verify re-hashes every block of the (optionally compressed) CARv1 or CARv2 snapshot read
+// from r and checks that the headers, messages, receipts and state roots of the rs recent
+// state roots window are all present. The blocks are spooled into a temporary disk store.
+func Verify(ctx context.Context, r io.Reader, rs int64) (*VerifyReport, error) {
+	dr, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close() //nolint:errcheck
+
+	br, err := carv2.NewBlockReader(dr, carv2.WithTrustedCAR(true))
+	if err != nil {
+		return nil, xerrors.Errorf("read car header: %w", err)
+	}
+	if len(br.Roots) == 0 {
+		return nil, xerrors.Errorf("car has no roots")
+	}
+
+	dir, err := os.MkdirTemp("", "snapshot-verify-*")
+	if err != nil {
+		return nil, xerrors.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	bs, err := NewDiskBlockStore(nil, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer bs.Close() //nolint:errcheck
+
+	report := &VerifyReport{
+		Roots: br.Roots,
+	}
+
+	all := cid.NewSet()
+	corrupted := cid.NewSet()
+	for {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("read block %d: %w", report.Blocks, err)
+		}
+		report.Blocks++
+
+		hashed, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil || !hashed.Equals(blk.Cid()) {
+			if corrupted.Visit(blk.Cid()) {
+				report.Corrupted = append(report.Corrupted, blk.Cid())
+			}
+			continue
+		}
+
+		all.Add(blk.Cid())
+		if err := bs.Put(ctx, blk.Cid(), blk); err != nil {
+			return nil, err
+		}
+	}
+
+	v := &verifier{
+		bs:        bs,
+		report:    report,
+		corrupted: corrupted,
+		reached:   cid.NewSet(),
+		walked:    cid.NewSet(),
+	}
+	if err := v.walk(ctx, rs); err != nil {
+		return nil, err
+	}
+
+	err = all.ForEach(func(c cid.Cid) error {
+		if !v.reached.Has(c) {
+			report.Extra = append(report.Extra, c)
+		}
+		return nil
+	})
+
+	return report, err
+}
+
+type verifier struct {
+	bs     common.DagStore
+	report *VerifyReport
+
+	// corrupted blocks are in the car, so they are not reported missing
+	corrupted *cid.Set
+	// reached tracks blocks of the car reached from the roots
+	reached *cid.Set
+	// walked tracks objects already walked, mirroring WalkSnapshot
+	walked *cid.Set
+}
+
+// walk follows the headers from the roots the way WalkSnapshot does
+func (v *verifier) walk(ctx context.Context, rs int64) error {
+	root, err := v.header(ctx, v.report.Roots[0])
+	if err != nil {
+		return xerrors.Errorf("load root header: %w", err)
+	}
+	if root == nil {
+		for _, c := range v.report.Roots {
+			v.missing(c)
+		}
+		return nil
+	}
+	v.report.Height = root.Height
+	v.report.TruncatedAt = root.Height
+
+	window := v.report.Height - abi.ChainEpoch(rs)
+
+	type pending struct {
+		c cid.Cid
+		// child is the height of the header linking to c
+		child abi.ChainEpoch
+	}
+
+	seen := cid.NewSet()
+	toWalk := make([]pending, 0, len(v.report.Roots))
+	for _, c := range v.report.Roots {
+		toWalk = append(toWalk, pending{c: c, child: v.report.Height + 1})
+	}
+
+	for len(toWalk) > 0 {
+		next := toWalk[0]
+		toWalk = toWalk[1:]
+		if !seen.Visit(next.c) {
+			continue
+		}
+
+		b, err := v.header(ctx, next.c)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			// parents below the window only truncate the chain
+			if next.child-1 > window {
+				v.missing(next.c)
+			}
+			continue
+		}
+
+		v.report.Headers++
+		v.reached.Add(next.c)
+		if b.Height < v.report.TruncatedAt {
+			v.report.TruncatedAt = b.Height
+		}
+
+		for _, p := range b.Parents {
+			toWalk = append(toWalk, pending{c: p, child: b.Height})
+		}
+
+		if b.Height > window {
+			if err := v.dag(ctx, b.Messages); err != nil {
+				return err
+			}
+		}
+
+		if b.Height == 0 || b.Height > window {
+			if err := v.dag(ctx, b.ParentStateRoot); err != nil {
+				return err
+			}
+
+			if v.walked.Visit(b.ParentMessageReceipts) && Exportable(b.ParentMessageReceipts) {
+				v.require(ctx, b.ParentMessageReceipts)
+			}
+		}
+	}
+
+	// a chain reaching genesis is not truncated
+	if v.report.TruncatedAt == 0 {
+		v.report.TruncatedAt = -1
+	}
+
+	return nil
+}
+
+// header loads and decodes a block header, nil if it is not in the car or corrupted
+func (v *verifier) header(ctx context.Context, c cid.Cid) (*types.BlockHeader, error) {
+	if has, _ := v.bs.Has(ctx, c); !has {
+		return nil, nil
+	}
+
+	blk, err := v.bs.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var b types.BlockHeader
+	if err := b.UnmarshalCBOR(bytes.NewBuffer(blk.RawData())); err != nil {
+		return nil, xerrors.Errorf("unmarshaling block header (cid=%s): %w", c, err)
+	}
+	return &b, nil
+}
+
+// require marks c as reached, or as missing when it is not in the car
+func (v *verifier) require(ctx context.Context, c cid.Cid) bool {
+	if has, _ := v.bs.Has(ctx, c); !has {
+		v.missing(c)
+		return false
+	}
+	v.reached.Add(c)
+	return true
+}
+
+// missing reports c as missing unless it is a corrupted block of the car
+func (v *verifier) missing(c cid.Cid) {
+	if !v.corrupted.Has(c) {
+		v.report.Missing = append(v.report.Missing, c)
+	}
+}
+
+// dag requires every dag-cbor object linked from root, as recurseLinks exports them
+func (v *verifier) dag(ctx context.Context, root cid.Cid) error {
+	if !v.walked.Visit(root) {
+		return nil
+	}
+	// the root is exported whatever its codec, only dag-cbor objects are scanned for links
+	if multicodec.Code(root.Prefix().Codec) != multicodec.DagCbor {
+		if Exportable(root) {
+			v.require(ctx, root)
+		}
+		return nil
+	}
+
+	toWalk := []cid.Cid{root}
+	for len(toWalk) > 0 {
+		c := toWalk[len(toWalk)-1]
+		toWalk = toWalk[:len(toWalk)-1]
+
+		if multicodec.Code(c.Prefix().Codec) != multicodec.DagCbor {
+			continue
+		}
+		if !v.require(ctx, c) {
+			continue
+		}
+
+		blk, err := v.bs.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		err = typegen.ScanForLinks(bytes.NewReader(blk.RawData()), func(l cid.Cid) {
+			if v.walked.Visit(l) {
+				toWalk = append(toWalk, l)
+			}
+		})
+		if err != nil {
+			return xerrors.Errorf("scanning for links of %s failed: %w", c, err)
+		}
+	}
+
+	return nil
+}
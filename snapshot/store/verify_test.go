@@ -0,0 +1,61 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/snapshot_snake/internal/testutil"
+	"testing"
+)
+
+func TestVerifyCorruptedNotMissing(t *testing.T) {
+	chain, objects := testutil.Chain(t, 30)
+	head := chain[len(chain)-1]
+	corrupted := objects[head.Cids()[0]][1].Cid()
+	extra := testutil.Object(t, 'x')
+
+	var buf bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: head.Cids(), Version: 1}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		blk, err := chain[i].Blocks()[0].ToStorageBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := carutil.LdWrite(&buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range objects[blk.Cid()] {
+			data := obj.RawData()
+			if obj.Cid() == corrupted {
+				data = []byte("corrupted")
+			}
+			if err := carutil.LdWrite(&buf, obj.Cid().Bytes(), data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := carutil.LdWrite(&buf, extra.Cid().Bytes(), extra.RawData()); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Verify(context.Background(), &buf, int64(len(chain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Corrupted) != 1 || report.Corrupted[0] != corrupted {
+		t.Fatalf("corrupted %v, want %s", report.Corrupted, corrupted)
+	}
+	if len(report.Missing) != 0 {
+		t.Fatalf("missing %v, want none", report.Missing)
+	}
+	if len(report.Extra) != 1 || report.Extra[0] != extra.Cid() {
+		t.Fatalf("extra %v, want %s", report.Extra, extra.Cid())
+	}
+	if report.Headers != len(chain) || report.TruncatedAt != chain[0].Height() {
+		t.Fatalf("%d headers truncated at %d, want %d truncated at %d", report.Headers, report.TruncatedAt, len(chain), chain[0].Height())
+	}
+}
@@ -0,0 +1,233 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/multiformats/go-multicodec"
+	"github.com/snapshot_snake/common"
+	"github.com/snapshot_snake/lib/metrics"
+	"github.com/snapshot_snake/snapshot/saaf"
+	typegen "github.com/whyrusleeping/cbor-gen"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"golang.org/x/xerrors"
+	"io"
+	"time"
+)
+
+// Export writes the snapshot of ts with rs recent state roots as a CARv1 into w
+func Export(ctx context.Context, bs common.DagStore, dag *saaf.DAG, ts *types.TipSet, w io.Writer, rs int64) error {
+	h := &car.CarHeader{
+		Roots:   ts.Cids(),
+		Version: 1,
+	}
+
+	if err := car.WriteHeader(h, w); err != nil {
+		return xerrors.Errorf("failed to write car header: %s", err)
+	}
+
+	begin := time.Now()
+	var written, size int64
+	err := WalkSnapshot(ctx, bs, dag, ts, rs, func(c cid.Cid, blk blocks.Block) error {
+		if blk == nil {
+			var err error
+			if blk, err = bs.Get(ctx, c); err != nil {
+				log.Errorf("cid ====> %s", c)
+				return xerrors.Errorf("writing object to car, bs.Get: %w", err)
+			}
+		}
+
+		if err := carutil.LdWrite(w, c.Bytes(), blk.RawData()); err != nil {
+			return xerrors.Errorf("failed to write block to car output: %w", err)
+		}
+
+		written++
+		size += int64(len(c.Bytes()) + len(blk.RawData()))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	recordExport(ctx, "full", begin, written, size)
+	return nil
+}
+
+// recordExport records the metrics of a finished export
+func recordExport(ctx context.Context, kind string, begin time.Time, blocks, size int64) {
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(metrics.ExportKind, kind)},
+		metrics.ExportDuration.M(float64(time.Since(begin).Milliseconds())),
+		metrics.ExportBlocks.M(blocks),
+		metrics.ExportBytes.M(size),
+	)
+}
+
+// WalkSnapshot calls cb for every object of the snapshot of ts, walking the headers linked in dag.
+// The headers are passed to cb with their block, the other objects are read from bs by cb.
+func WalkSnapshot(ctx context.Context, bs common.DagStore, dag *saaf.DAG, ts *types.TipSet, rs int64, cb func(cid.Cid, blocks.Block) error) error {
+	seen := cid.NewSet()
+	walked := cid.NewSet()
+
+	blocksToWalk := ts.Cids()
+
+	// walk a view, so headers unlinked during the walk do not truncate the snapshot
+	nodes := dag.View()
+	defer nodes.Close()
+	progress := progressFrom(ctx)
+
+	walkDAG := func(blk cid.Cid) error {
+		if !seen.Visit(blk) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// parents of the oldest linked tipset mark the end of the cached window
+		node, err := nodes.Get(blk)
+		if err != nil {
+			log.Debugf("stop walking at %s: %s", blk, err)
+			return nil
+		}
+
+		// the header comes from the view, the cache may drop it once it leaves the window
+		sn, ok := node.(*saaf.SnapNode)
+		if !ok {
+			return xerrors.Errorf("unexpected node type %T (cid=%s)", node, blk)
+		}
+		b := sn.GetBlkHeader()
+		data, err := sn.GetBlock()
+		if err != nil {
+			return xerrors.Errorf("serializing block header (cid=%s): %w", blk, err)
+		}
+
+		if err := cb(blk, data); err != nil {
+			return err
+		}
+		progress.block()
+		progress.walked(b.Height)
+
+		var cids []cid.Cid
+		blocksToWalk = append(blocksToWalk, node.Parents()...)
+
+		if b.Height > ts.Height()-abi.ChainEpoch(rs) {
+			if walked.Visit(b.Messages) {
+				mcids, err := recurseLinks(ctx, bs, walked, b.Messages, []cid.Cid{b.Messages})
+				if err != nil {
+					return xerrors.Errorf("cid %s, bid %s, bid.msg %s, recursing messages failed: %w", blk, b.Cid(), b.Messages, err)
+				}
+				cids = mcids
+			}
+		}
+
+		out := cids
+
+		if b.Height == 0 || b.Height > ts.Height()-abi.ChainEpoch(rs) {
+			if walked.Visit(b.ParentStateRoot) {
+				cids, err := recurseLinks(ctx, bs, walked, b.ParentStateRoot, []cid.Cid{b.ParentStateRoot})
+				if err != nil {
+					return xerrors.Errorf("recursing genesis state failed: %w", err)
+				}
+
+				out = append(out, cids...)
+			}
+
+			if walked.Visit(b.ParentMessageReceipts) {
+				out = append(out, b.ParentMessageReceipts)
+			}
+		}
+
+		for _, c := range out {
+			if seen.Visit(c) {
+				if !Exportable(c) {
+					continue
+				}
+
+				if err := cb(c, nil); err != nil {
+					return err
+				}
+				progress.block()
+			}
+		}
+
+		return nil
+	}
+
+	log.Infow("export started")
+	exportStart := build.Clock.Now()
+
+	for len(blocksToWalk) > 0 {
+		next := blocksToWalk[0]
+		blocksToWalk = blocksToWalk[1:]
+		if err := walkDAG(next); err != nil {
+			return xerrors.Errorf("walk chain failed: %w", err)
+		}
+	}
+
+	log.Infow("export finished", "duration", build.Clock.Now().Sub(exportStart).Seconds())
+
+	return nil
+}
+
+func recurseLinks(ctx context.Context, bs common.DagStore, walked *cid.Set, root cid.Cid, in []cid.Cid) ([]cid.Cid, error) {
+	// identity objects are not fetched nor exported
+	if multicodec.Code(root.Prefix().Codec) != multicodec.DagCbor || !Exportable(root) {
+		return in, nil
+	}
+
+	data, err := bs.Get(ctx, root)
+	if err != nil {
+		return nil, xerrors.Errorf("object %s not in cache: %w", root, err)
+	}
+
+	in = append(in, root)
+
+	var rerr error
+	err = typegen.ScanForLinks(bytes.NewReader(data.RawData()), func(c cid.Cid) {
+		if rerr != nil {
+			// No error return on ScanForLinks :(
+			return
+		}
+
+		// traversed this already...
+		if !walked.Visit(c) {
+			return
+		}
+
+		var err error
+		in, err = recurseLinks(ctx, bs, walked, c, in)
+		if err != nil {
+			rerr = err
+		}
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("scanning for links failed: %w", err)
+	}
+
+	return in, rerr
+}
+
+// Exportable reports whether an object linked from a header is written into snapshots
+func Exportable(c cid.Cid) bool {
+	prefix := c.Prefix()
+
+	// Don't include identity CIDs.
+	if multicodec.Code(prefix.MhType) == multicodec.Identity {
+		return false
+	}
+
+	// We only include raw, cbor, and dagcbor, for now.
+	switch multicodec.Code(prefix.Codec) {
+	case multicodec.Cbor, multicodec.DagCbor, multicodec.Raw:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"context"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/snapshot_snake/internal/testutil"
+	"testing"
+)
+
+func TestRecurseLinksMissingObject(t *testing.T) {
+	ctx := context.Background()
+
+	leaf := testutil.Node(t, 2)
+	child := testutil.Node(t, 1, leaf.Cid())
+	root := testutil.Node(t, 0, child.Cid())
+
+	bs, err := NewCacheBlockStore(nil, DefaultCacheSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blk := range []blocks.Block{root, leaf} {
+		if err := bs.Put(ctx, blk.Cid(), blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the child was evicted
+	if _, err := recurseLinks(ctx, bs, cid.NewSet(), root.Cid(), nil); err == nil {
+		t.Fatal("walked a dag with a missing object")
+	}
+
+	if err := bs.Put(ctx, child.Cid(), child); err != nil {
+		t.Fatal(err)
+	}
+	cids, err := recurseLinks(ctx, bs, cid.NewSet(), root.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cids) != 3 {
+		t.Fatalf("walked %d objects, want 3", len(cids))
+	}
+}